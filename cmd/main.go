@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"qiscus-agent-allocation/internal/config"
 	"qiscus-agent-allocation/internal/handler"
@@ -17,6 +21,8 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -28,8 +34,8 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
-	// Initialize Redis client
-	client, err := redisClient.NewClient(cfg.RedisURL)
+	// Initialize Redis client, each worker holds a connection while it waits
+	client, err := redisClient.NewClient(cfg.RedisURL, cfg.WorkerCount)
 	if err != nil {
 		log.Fatal("Failed to connect to Redis:", err)
 	}
@@ -37,25 +43,93 @@ func main() {
 
 	// Initialize Qiscus client
 	qiscusClient := qiscus.NewClient(qiscus.Config{
-		BaseURL:   cfg.QiscusConfig.BaseURL,
-		AppID:     cfg.QiscusConfig.AppID,
-		SecretKey: cfg.QiscusConfig.SecretKey,
-		Timeout:   cfg.QiscusConfig.Timeout,
+		BaseURL:     cfg.QiscusConfig.BaseURL,
+		AppID:       cfg.QiscusConfig.AppID,
+		SecretKey:   cfg.QiscusConfig.SecretKey,
+		SenderEmail: cfg.QiscusConfig.SenderEmail,
+		Timeout:     cfg.QiscusConfig.Timeout,
 	})
 
 	// Initialize repositories
-	agentRepo := redisRepo.NewAgentRepository(client)
-	queueRepo := redisRepo.NewQueueRepository(client)
+	agentRepo := redisRepo.NewAgentRepository(client, cfg.DefaultMaxCapacity)
+	queueRepo := redisRepo.NewQueueRepository(client, cfg.QueueConfig.Reliable, cfg.QueueConfig.VisibilityTimeout)
 	agentQiscusRepo := qiscusRepo.NewAgentQiscusRepository(qiscusClient)
+	nonceRepo := redisRepo.NewNonceRepository(client)
+	auditRepo := redisRepo.NewAuditRepository(client)
+
+	divisionRoutes := usecase.DivisionRoutes(cfg.DivisionRoutes)
 
 	// Initialize use cases
-	allocationUsecase := usecase.NewAllocationUsecase(agentRepo, queueRepo, agentQiscusRepo)
+	allocationUsecase := usecase.NewAllocationUsecase(agentRepo, queueRepo, agentQiscusRepo, usecase.PriorityRules{
+		VIPEmails:         cfg.PriorityConfig.VIPEmails,
+		VIPPriority:       cfg.PriorityConfig.VIPPriority,
+		ChannelPriorities: cfg.PriorityConfig.ChannelPriorities,
+	}, divisionRoutes, auditRepo)
+
+	// Initialize allocation strategy
+	strategy, err := usecase.NewAllocationStrategy(cfg.AllocationStrategy, agentRepo)
+	if err != nil {
+		log.Fatal("Failed to initialize allocation strategy:", err)
+	}
+
+	// Initialize business hours
+	schedules := make([]usecase.BusinessHoursSchedule, 0, len(cfg.BusinessHours))
+	for _, s := range cfg.BusinessHours {
+		schedules = append(schedules, usecase.BusinessHoursSchedule(s))
+	}
+	businessHours, err := usecase.NewBusinessHours(schedules, divisionRoutes)
+	if err != nil {
+		log.Fatal("Failed to initialize business hours:", err)
+	}
+
+	// Initialize queue position notifier
+	var notifierService *service.NotifierService
+	if cfg.NotifierConfig.Enabled {
+		notifierService = service.NewNotifierService(allocationUsecase, service.NotifierConfig{
+			Interval:      cfg.NotifierConfig.Interval,
+			DefaultWait:   cfg.NotifierConfig.DefaultWait,
+			Templates:     cfg.NotifierConfig.Templates,
+			BusinessHours: businessHours,
+		})
+	}
 
 	// Initialize handlers
-	webhookHandler := handler.NewWebhookHandler(allocationUsecase)
+	webhookHandler := handler.NewWebhookHandler(allocationUsecase, notifierService)
+	webhookAuth, err := handler.NewWebhookAuth(handler.WebhookAuthConfig{
+		Mode:            cfg.WebhookAuthConfig.Mode,
+		Secret:          cfg.WebhookAuthConfig.Secret,
+		SecretHeader:    cfg.WebhookAuthConfig.SecretHeader,
+		SignatureHeader: cfg.WebhookAuthConfig.SignatureHeader,
+		TimestampHeader: cfg.WebhookAuthConfig.TimestampHeader,
+		NonceHeader:     cfg.WebhookAuthConfig.NonceHeader,
+		ReplayWindow:    cfg.WebhookAuthConfig.ReplayWindow,
+	}, nonceRepo)
+	if err != nil {
+		log.Fatal("Failed to initialize webhook authentication:", err)
+	}
 
 	// Initialize worker service
-	workerService := service.NewWorkerService(allocationUsecase)
+	workerService := service.NewWorkerService(allocationUsecase, service.WorkerConfig{
+		Workers:           cfg.WorkerCount,
+		PopTimeout:        cfg.QueueConfig.PopTimeout,
+		SkillFallbackWait: cfg.SkillFallbackWait,
+		Strategy:          strategy,
+		StickyTTL:         cfg.StickyTTL,
+		BusinessHours:     businessHours,
+		MaxAttempts:       cfg.QueueConfig.MaxAttempts,
+		RetryBaseDelay:    cfg.QueueConfig.RetryBaseDelay,
+		RetryMaxDelay:     cfg.QueueConfig.RetryMaxDelay,
+	})
+	recoveryService := service.NewRecoveryService(allocationUsecase, cfg.QueueConfig.RecoveryInterval)
+	delayedQueueService := service.NewDelayedQueueService(allocationUsecase, cfg.QueueConfig.DelayedInterval)
+	reconcilerService := service.NewReconcilerService(allocationUsecase, cfg.ReconcileInterval)
+
+	// Initialize admin handler
+	adminHandler := handler.NewAdminHandler(allocationUsecase, reconcilerService)
+	adminAuth, err := handler.NewAdminAuth(cfg.AdminToken)
+	if err != nil {
+		log.Fatal("Failed to initialize admin authentication, set ADMIN_TOKEN:", err)
+	}
 
 	// Setup routes
 	r := chi.NewRouter()
@@ -66,19 +140,143 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// Prometheus metrics
+	prometheus.MustRegister(service.NewQueueCollector(allocationUsecase))
+	r.Handle("/metrics", promhttp.Handler())
+
 	// Webhook routes
 	r.Route("/webhook", func(r chi.Router) {
+		r.Use(webhookAuth)
 		r.Post("/incoming", webhookHandler.HandleIncoming)
 		r.Post("/resolved", webhookHandler.HandleResolved)
 	})
 
+	// Admin routes
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(adminAuth)
+		r.Get("/agents/{agentID}/capacity", adminHandler.GetAgentCapacity)
+		r.Put("/agents/{agentID}/capacity", adminHandler.SetAgentMaxCapacity)
+		r.Delete("/agents/{agentID}/capacity", adminHandler.ResetAgentMaxCapacity)
+		r.Get("/agents/{agentID}/skills", adminHandler.GetAgentSkills)
+		r.Put("/agents/{agentID}/skills", adminHandler.SetAgentSkills)
+		r.Post("/reconcile", adminHandler.Reconcile)
+		r.Get("/queue", adminHandler.ListQueue)
+		r.Get("/queue/position", adminHandler.GetQueuePosition)
+		r.Post("/queue/flush", adminHandler.FlushQueue)
+		r.Delete("/queue/rooms/{roomID}", adminHandler.RemoveFromQueue)
+		r.Post("/queue/rooms/{roomID}/front", adminHandler.MoveToFront)
+		r.Put("/queue/priority", adminHandler.SetQueuePriority)
+		r.Get("/queue/dead", adminHandler.ListDeadLetters)
+		r.Delete("/queue/dead", adminHandler.PurgeDeadLetters)
+		r.Post("/queue/dead/{roomID}/retry", adminHandler.RetryDeadLetter)
+		r.Delete("/queue/dead/{roomID}", adminHandler.PurgeDeadLetter)
+		r.Post("/rooms/{roomID}/assign", adminHandler.AssignRoom)
+		r.Get("/audit", adminHandler.ListAuditLog)
+	})
+
+	// Cancel background services on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+
+	// Move customers still waiting in the list based queue of older versions
+	migrated, err := allocationUsecase.MigrateLegacyQueue()
+	if err != nil {
+		log.Fatal("Failed to migrate legacy queue:", err)
+	}
+	if migrated > 0 {
+		log.Printf("Migrated %d customers from the legacy queue", migrated)
+	}
+
+	// Rebuild agent rooms from Qiscus before the workers assign anything, so
+	// agents don't look empty after an upgrade from the old counter keys
+	if _, err := reconcilerService.Reconcile(); err != nil {
+		log.Printf("Failed to reconcile agent capacity at startup: %v", err)
+	}
+
 	// Start worker in background
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		log.Println("Starting worker service...")
-		workerService.Start(context.Background())
+		workerService.Start(ctx)
+	}()
+
+	// Start in-flight recovery in background
+	if cfg.QueueConfig.Reliable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recoveryService.Start(ctx)
+		}()
+	}
+
+	// Start moving due delayed items back to the queue in background
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		delayedQueueService.Start(ctx)
 	}()
 
+	// Start queue position messages in background
+	if notifierService != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifierService.Start(ctx)
+		}()
+	}
+
+	// Start capacity reconciliation in background
+	if cfg.ReconcileInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reconcilerService.Start(ctx)
+		}()
+	}
+
 	// Start server
-	fmt.Printf("Server starting on port %s\n", cfg.Port)
-	log.Fatal(http.ListenAndServe(":"+cfg.Port, r))
+	server := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: r,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Server starting on port %s\n", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+		stop()
+	}
+
+	// Drain HTTP server and background services within the deadline
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server gracefully: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("Shutdown complete")
+	case <-shutdownCtx.Done():
+		log.Println("Shutdown deadline exceeded, exiting")
+	}
 }
@@ -1,24 +1,86 @@
 package config
 
 import (
+	"encoding/json"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Port           string
-	RedisURL       string
-	PostgresURL    string
-	RequestTimeout time.Duration
-	QiscusConfig   QiscusConfig
+	Port               string
+	RedisURL           string
+	PostgresURL        string
+	RequestTimeout     time.Duration
+	ShutdownTimeout    time.Duration
+	WorkerCount        int
+	SkillFallbackWait  time.Duration
+	AllocationStrategy string
+	StickyTTL          time.Duration
+	DefaultMaxCapacity int
+	ReconcileInterval  time.Duration
+	QueueConfig        QueueConfig
+	PriorityConfig     PriorityConfig
+	DivisionRoutes     map[string][]int
+	BusinessHours      []BusinessHoursSchedule
+	NotifierConfig     NotifierConfig
+	WebhookAuthConfig  WebhookAuthConfig
+	AdminToken         string
+	QiscusConfig       QiscusConfig
+}
+
+type WebhookAuthConfig struct {
+	Mode            string
+	Secret          string
+	SecretHeader    string
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+	ReplayWindow    time.Duration
+}
+
+type NotifierConfig struct {
+	Enabled     bool
+	Interval    time.Duration
+	DefaultWait time.Duration
+	Templates   map[string]string
+}
+
+// BusinessHoursSchedule is one entry of the BUSINESS_HOURS JSON list
+type BusinessHoursSchedule struct {
+	Channel           string            `json:"channel,omitempty"`
+	DivisionID        int               `json:"division_id,omitempty"`
+	Timezone          string            `json:"timezone"`
+	Hours             map[string]string `json:"hours"`
+	Holidays          []string          `json:"holidays,omitempty"`
+	AfterHoursMessage string            `json:"after_hours_message,omitempty"`
+}
+
+type PriorityConfig struct {
+	VIPEmails         []string
+	VIPPriority       int
+	ChannelPriorities map[string]int
+}
+
+type QueueConfig struct {
+	PopTimeout        time.Duration
+	Reliable          bool
+	VisibilityTimeout time.Duration
+	RecoveryInterval  time.Duration
+	DelayedInterval   time.Duration
+	MaxAttempts       int
+	RetryBaseDelay    time.Duration
+	RetryMaxDelay     time.Duration
 }
 
 type QiscusConfig struct {
-	BaseURL   string
-	AppID     string
-	SecretKey string
-	Timeout   time.Duration
+	BaseURL     string
+	AppID       string
+	SecretKey   string
+	SenderEmail string
+	Timeout     time.Duration
 }
 
 func Load() *Config {
@@ -43,16 +105,206 @@ func Load() *Config {
 	log.Println("Qiscus App ID:", os.Getenv("QISCUS_APP_ID"))
 	log.Println("Qiscus Secret Key:", os.Getenv("QISCUS_SECRET_KEY"))
 
+	var businessHours []BusinessHoursSchedule
+	getEnvJSON("BUSINESS_HOURS", &businessHours)
+
+	var positionTemplates map[string]string
+	getEnvJSON("QUEUE_NOTIFY_TEMPLATES", &positionTemplates)
+
 	return &Config{
-		Port:           port,
-		RedisURL:       redisURL,
-		PostgresURL:    postgresURL,
-		RequestTimeout: 60 * time.Second,
+		Port:               port,
+		RedisURL:           redisURL,
+		PostgresURL:        postgresURL,
+		RequestTimeout:     60 * time.Second,
+		ShutdownTimeout:    getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		WorkerCount:        getEnvInt("WORKER_COUNT", 1),
+		SkillFallbackWait:  getEnvDuration("SKILL_FALLBACK_WAIT", 2*time.Minute),
+		AllocationStrategy: getEnv("ALLOCATION_STRATEGY", "least_loaded"),
+		StickyTTL:          getEnvDuration("STICKY_AGENT_TTL", 24*time.Hour),
+		DefaultMaxCapacity: getEnvInt("AGENT_MAX_CAPACITY", 2),
+		ReconcileInterval:  getEnvDuration("RECONCILE_INTERVAL", 5*time.Minute),
+		QueueConfig: QueueConfig{
+			PopTimeout:        getEnvDuration("QUEUE_POP_TIMEOUT", 5*time.Second),
+			Reliable:          getEnvBool("QUEUE_RELIABLE", true),
+			VisibilityTimeout: getEnvDuration("QUEUE_VISIBILITY_TIMEOUT", 60*time.Second),
+			RecoveryInterval:  getEnvPositiveDuration("QUEUE_RECOVERY_INTERVAL", 30*time.Second),
+			DelayedInterval:   getEnvPositiveDuration("QUEUE_DELAYED_INTERVAL", time.Second),
+			MaxAttempts:       getEnvInt("QUEUE_MAX_ATTEMPTS", 5),
+			RetryBaseDelay:    getEnvDuration("QUEUE_RETRY_BASE_DELAY", 2*time.Second),
+			RetryMaxDelay:     getEnvDuration("QUEUE_RETRY_MAX_DELAY", time.Minute),
+		},
+		PriorityConfig: PriorityConfig{
+			VIPEmails:         getEnvList("PRIORITY_VIP_EMAILS"),
+			VIPPriority:       getEnvInt("PRIORITY_VIP", 10),
+			ChannelPriorities: getEnvIntMap("PRIORITY_CHANNELS"),
+		},
+		DivisionRoutes: getEnvIntListMap("DIVISION_ROUTES"),
+		BusinessHours:  businessHours,
+		NotifierConfig: NotifierConfig{
+			Enabled:     getEnvBool("QUEUE_NOTIFY", false),
+			Interval:    getEnvDuration("QUEUE_NOTIFY_INTERVAL", 2*time.Minute),
+			DefaultWait: getEnvDuration("QUEUE_NOTIFY_DEFAULT_WAIT", 3*time.Minute),
+			Templates:   positionTemplates,
+		},
+		WebhookAuthConfig: WebhookAuthConfig{
+			Mode:            getEnv("WEBHOOK_AUTH", ""),
+			Secret:          os.Getenv("WEBHOOK_SECRET"),
+			SecretHeader:    getEnv("WEBHOOK_SECRET_HEADER", "X-Webhook-Secret"),
+			SignatureHeader: getEnv("WEBHOOK_SIGNATURE_HEADER", "X-Webhook-Signature"),
+			TimestampHeader: getEnv("WEBHOOK_TIMESTAMP_HEADER", "X-Webhook-Timestamp"),
+			NonceHeader:     getEnv("WEBHOOK_NONCE_HEADER", "X-Webhook-Nonce"),
+			ReplayWindow:    getEnvDuration("WEBHOOK_REPLAY_WINDOW", 5*time.Minute),
+		},
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
 		QiscusConfig: QiscusConfig{
-			BaseURL:   qiscusBaseURL,
-			AppID:     os.Getenv("QISCUS_APP_ID"),
-			SecretKey: os.Getenv("QISCUS_SECRET_KEY"),
-			Timeout:   30 * time.Second,
+			BaseURL:     qiscusBaseURL,
+			AppID:       os.Getenv("QISCUS_APP_ID"),
+			SecretKey:   os.Getenv("QISCUS_SECRET_KEY"),
+			SenderEmail: os.Getenv("QISCUS_SENDER_EMAIL"),
+			Timeout:     30 * time.Second,
 		},
 	}
 }
+
+// getEnv reads a string env variable, returning fallback when unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// getEnvInt reads an integer env variable, returning fallback when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+// getEnvBool reads a boolean env variable, returning fallback when unset or invalid
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %t", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+// getEnvDuration reads a duration env variable (e.g. "30s"), returning fallback when unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %s", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+// getEnvPositiveDuration reads a duration env variable that can't be turned
+// off, returning fallback when unset, invalid, zero or negative
+func getEnvPositiveDuration(key string, fallback time.Duration) time.Duration {
+	value := getEnvDuration(key, fallback)
+	if value <= 0 {
+		log.Printf("Invalid value for %s: %s, must be positive, using default %s", key, value, fallback)
+		return fallback
+	}
+
+	return value
+}
+
+// getEnvList reads a comma separated env variable, e.g. "a@x.com,b@y.com"
+func getEnvList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+// getEnvIntMap reads a comma separated list of key:int pairs, e.g. "wa:1,ig:2".
+// Keys are lower cased and invalid pairs are skipped.
+func getEnvIntMap(key string) map[string]int {
+	result := make(map[string]int)
+	for _, pair := range getEnvList(key) {
+		name, value, found := strings.Cut(pair, ":")
+		if !found {
+			log.Printf("Invalid entry in %s: %q, expected name:number", key, pair)
+			continue
+		}
+
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			log.Printf("Invalid entry in %s: %q, expected name:number", key, pair)
+			continue
+		}
+
+		result[strings.ToLower(strings.TrimSpace(name))] = parsed
+	}
+
+	return result
+}
+
+// getEnvIntListMap reads a comma separated list of key:int|int pairs, e.g.
+// "wa:1|2,ig:3". Keys are lower cased and invalid pairs are skipped.
+func getEnvIntListMap(key string) map[string][]int {
+	result := make(map[string][]int)
+	for _, pair := range getEnvList(key) {
+		name, values, found := strings.Cut(pair, ":")
+		if !found {
+			log.Printf("Invalid entry in %s: %q, expected name:number|number", key, pair)
+			continue
+		}
+
+		var numbers []int
+		for _, value := range strings.Split(values, "|") {
+			parsed, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				log.Printf("Invalid number in %s: %q", key, value)
+				continue
+			}
+			numbers = append(numbers, parsed)
+		}
+
+		result[strings.ToLower(strings.TrimSpace(name))] = numbers
+	}
+
+	return result
+}
+
+// getEnvJSON decodes a JSON env variable into target, leaving it unchanged when unset or invalid
+func getEnvJSON(key string, target interface{}) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		log.Printf("Invalid JSON in %s: %v, ignoring it", key, err)
+	}
+}
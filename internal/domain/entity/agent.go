@@ -7,6 +7,14 @@ type Agent struct {
 	IsAvailable bool   `json:"is_available"`
 }
 
+type AgentCapacity struct {
+	AgentID         string   `json:"agent_id"`
+	Rooms           []string `json:"rooms"`
+	CurrentCapacity int      `json:"current_capacity"`
+	MaxCapacity     int      `json:"max_capacity"`
+	DefaultCapacity int      `json:"default_capacity"`
+}
+
 type QiscusAgent struct {
 	ID          int    `json:"id"`
 	Name        string `json:"name"`
@@ -22,8 +30,16 @@ type GetAgentsResponse struct {
 }
 
 type AssignAgentRequest struct {
-	RoomID  string `json:"room_id"`
-	AgentID string `json:"agent_id"`
+	RoomID             string `json:"room_id"`
+	AgentID            string `json:"agent_id"`
+	ReplaceLatestAgent bool   `json:"replace_latest_agent,omitempty"`
+}
+
+type SendMessageRequest struct {
+	SenderEmail string `json:"sender_email"`
+	Message     string `json:"message"`
+	Type        string `json:"type"`
+	RoomID      string `json:"room_id"`
 }
 
 type AssignAgentResponse struct {
@@ -31,3 +47,46 @@ type AssignAgentResponse struct {
 	Data    interface{} `json:"data"`
 	Message string      `json:"message,omitempty"`
 }
+
+type GetCustomerRoomsRequest struct {
+	Status      string `json:"status"`
+	ServeStatus string `json:"serve_status"`
+	AgentIDs    []int  `json:"agent_ids"`
+	Limit       int    `json:"limit"`
+	CursorAfter string `json:"cursor_after,omitempty"`
+}
+
+type CustomerRoom struct {
+	ID         int    `json:"id"`
+	RoomID     string `json:"room_id"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	IsResolved bool   `json:"is_resolved"`
+}
+
+type GetCustomerRoomsResponse struct {
+	Status int `json:"status"`
+	Data   struct {
+		CustomerRooms []CustomerRoom `json:"customer_rooms"`
+	} `json:"data"`
+	Meta struct {
+		CursorAfter string `json:"cursor_after"`
+	} `json:"meta"`
+}
+
+type CapacityCorrection struct {
+	AgentID      string   `json:"agent_id"`
+	Before       int      `json:"before"`
+	After        int      `json:"after"`
+	AddedRooms   []string `json:"added_rooms"`
+	RemovedRooms []string `json:"removed_rooms"`
+}
+
+type ManualAssignment struct {
+	RoomID           string `json:"room_id"`
+	AgentID          string `json:"agent_id"`
+	PreviousAgentID  string `json:"previous_agent_id,omitempty"`
+	AgentLoad        int    `json:"agent_load"`
+	AgentMaxCapacity int    `json:"agent_max_capacity"`
+	RemovedFromQueue int    `json:"removed_from_queue"`
+}
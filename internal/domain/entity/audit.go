@@ -0,0 +1,12 @@
+package entity
+
+type AuditEntry struct {
+	Timestamp       int64  `json:"timestamp"`
+	Actor           string `json:"actor"`
+	RemoteAddr      string `json:"remote_addr"`
+	Action          string `json:"action"`
+	RoomID          string `json:"room_id"`
+	AgentID         string `json:"agent_id"`
+	PreviousAgentID string `json:"previous_agent_id,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
@@ -6,5 +6,42 @@ type QueueItem struct {
 	CustomerID string    `json:"customer_id"`
 	RoomID     string    `json:"room_id"`
 	Channel    string    `json:"channel"`
+	Priority   int       `json:"priority"`
 	Timestamp  time.Time `json:"timestamp"`
+
+	// CandidateAgentID is the agent Qiscus suggested in the webhook, if any
+	CandidateAgentID string `json:"candidate_agent_id,omitempty"`
+
+	// AfterHoursNotified is set once the after-hours reply was sent to the room
+	AfterHoursNotified bool `json:"after_hours_notified,omitempty"`
+
+	// Retries counts every failed allocation, Attempts only failed assignments
+	// via Qiscus, which move the item to the dead-letter queue after a limit
+	Retries   int    `json:"retries,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// States of an item in the queue
+const (
+	QueueStateQueued   = "queued"
+	QueueStateDelayed  = "delayed"
+	QueueStateInFlight = "in_flight"
+)
+
+// QueueEntry is an item in the queue with its state and place in line.
+// In-flight items are being assigned and have no position.
+type QueueEntry struct {
+	QueueItem
+	State       string `json:"state"`
+	Position    int    `json:"position,omitempty"`
+	WaitSeconds int64  `json:"wait_seconds"`
+}
+
+// QueueStats counts the items in each part of the queue
+type QueueStats struct {
+	Queued   int64 `json:"queued"`
+	Delayed  int64 `json:"delayed"`
+	InFlight int64 `json:"in_flight"`
+	Dead     int64 `json:"dead"`
 }
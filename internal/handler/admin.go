@@ -0,0 +1,474 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"qiscus-agent-allocation/internal/service"
+	"qiscus-agent-allocation/internal/usecase"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AdminHandler struct {
+	allocationUsecase usecase.AllocationUsecase
+	reconciler        *service.ReconcilerService
+}
+
+func NewAdminHandler(allocationUsecase usecase.AllocationUsecase, reconciler *service.ReconcilerService) *AdminHandler {
+	return &AdminHandler{
+		allocationUsecase: allocationUsecase,
+		reconciler:        reconciler,
+	}
+}
+
+type setMaxCapacityRequest struct {
+	MaxCapacity *int `json:"max_capacity"`
+}
+
+// GetAgentCapacity returns current load and max capacity of an agent
+func (h *AdminHandler) GetAgentCapacity(w http.ResponseWriter, r *http.Request) {
+	agentID := chi.URLParam(r, "agentID")
+
+	info, err := h.allocationUsecase.GetAgentCapacityInfo(agentID)
+	if err != nil {
+		log.Printf("Failed to get agent capacity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// SetAgentMaxCapacity sets the max capacity of an agent
+func (h *AdminHandler) SetAgentMaxCapacity(w http.ResponseWriter, r *http.Request) {
+	agentID := chi.URLParam(r, "agentID")
+
+	var req setMaxCapacityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxCapacity == nil || *req.MaxCapacity < 0 {
+		http.Error(w, "max_capacity must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.allocationUsecase.SetAgentMaxCapacity(agentID, *req.MaxCapacity); err != nil {
+		log.Printf("Failed to set agent max capacity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.GetAgentCapacity(w, r)
+}
+
+// ResetAgentMaxCapacity removes the per-agent max capacity so the default applies
+func (h *AdminHandler) ResetAgentMaxCapacity(w http.ResponseWriter, r *http.Request) {
+	agentID := chi.URLParam(r, "agentID")
+
+	if err := h.allocationUsecase.ResetAgentMaxCapacity(agentID); err != nil {
+		log.Printf("Failed to reset agent max capacity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.GetAgentCapacity(w, r)
+}
+
+type setSkillsRequest struct {
+	Skills []string `json:"skills"`
+}
+
+// GetAgentSkills returns the channels an agent serves
+func (h *AdminHandler) GetAgentSkills(w http.ResponseWriter, r *http.Request) {
+	agentID := chi.URLParam(r, "agentID")
+
+	skills, err := h.allocationUsecase.GetAgentSkills(agentID)
+	if err != nil {
+		log.Printf("Failed to get agent skills: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent_id": agentID,
+		"skills":   skills,
+	})
+}
+
+// SetAgentSkills replaces the channels an agent serves, an empty list makes it a generalist
+func (h *AdminHandler) SetAgentSkills(w http.ResponseWriter, r *http.Request) {
+	agentID := chi.URLParam(r, "agentID")
+
+	var req setSkillsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.allocationUsecase.SetAgentSkills(agentID, req.Skills); err != nil {
+		log.Printf("Failed to set agent skills: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.GetAgentSkills(w, r)
+}
+
+// Reconcile triggers a capacity reconciliation against Qiscus and returns the corrections made
+func (h *AdminHandler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	corrections, err := h.reconciler.Reconcile()
+	if err != nil {
+		log.Printf("Failed to reconcile agent capacity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "reconciled",
+		"corrections": corrections,
+	})
+}
+
+type setQueuePriorityRequest struct {
+	RoomID     string `json:"room_id"`
+	Channel    string `json:"channel"`
+	CustomerID string `json:"customer_id"`
+	Priority   *int   `json:"priority"`
+}
+
+// SetQueuePriority changes the priority of a queued customer
+func (h *AdminHandler) SetQueuePriority(w http.ResponseWriter, r *http.Request) {
+	var req setQueuePriorityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if req.RoomID == "" || req.CustomerID == "" || req.Priority == nil {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.allocationUsecase.SetQueuePriority(req.RoomID, req.Channel, req.CustomerID, *req.Priority)
+	if errors.Is(err, usecase.ErrNotInQueue) {
+		http.Error(w, "Customer not in queue", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to set queue priority: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
+}
+
+// ListDeadLetters returns the items that failed assignment too many times
+func (h *AdminHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	items, err := h.allocationUsecase.ListDeadLetters()
+	if err != nil {
+		log.Printf("Failed to list dead-letter queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(items),
+		"items": items,
+	})
+}
+
+// RetryDeadLetter puts a dead-lettered room back in the queue
+func (h *AdminHandler) RetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+
+	item, err := h.allocationUsecase.RetryDeadLetter(roomID)
+	if errors.Is(err, usecase.ErrNotDeadLettered) {
+		http.Error(w, "Room not in dead-letter queue", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to retry dead-lettered room: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
+}
+
+// PurgeDeadLetter drops a dead-lettered room
+func (h *AdminHandler) PurgeDeadLetter(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+
+	err := h.allocationUsecase.PurgeDeadLetter(roomID)
+	if errors.Is(err, usecase.ErrNotDeadLettered) {
+		http.Error(w, "Room not in dead-letter queue", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to purge dead-lettered room: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeDeadLetters drops every dead-lettered item
+func (h *AdminHandler) PurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	count, err := h.allocationUsecase.PurgeDeadLetters()
+	if err != nil {
+		log.Printf("Failed to purge dead-letter queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "purged",
+		"count":  count,
+	})
+}
+
+// ListQueue returns the customers in the queue with their state and wait time
+func (h *AdminHandler) ListQueue(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.allocationUsecase.GetQueueStats()
+	if err != nil {
+		log.Printf("Failed to get queue stats: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := h.allocationUsecase.ListQueueEntries()
+	if err != nil {
+		log.Printf("Failed to list queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stats": stats,
+		"items": entries,
+	})
+}
+
+// GetQueuePosition returns the place in the queue of a room or customer
+func (h *AdminHandler) GetQueuePosition(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("room_id")
+	customerID := r.URL.Query().Get("customer_id")
+
+	if roomID == "" && customerID == "" {
+		http.Error(w, "room_id or customer_id is required", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.allocationUsecase.FindQueueEntry(roomID, customerID)
+	if errors.Is(err, usecase.ErrNotInQueue) {
+		http.Error(w, "Customer not in queue", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to find queue entry: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// RemoveFromQueue drops a room that is waiting in the queue
+func (h *AdminHandler) RemoveFromQueue(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+
+	removed, err := h.allocationUsecase.RemoveFromQueue(roomID)
+	if err != nil {
+		log.Printf("Failed to remove room from queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if removed == 0 {
+		http.Error(w, "Room not in queue", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MoveToFront makes a queued or delayed room the next one to be allocated
+func (h *AdminHandler) MoveToFront(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+
+	item, err := h.allocationUsecase.MoveToFront(roomID)
+	if errors.Is(err, usecase.ErrNotInQueue) {
+		http.Error(w, "Room not in queue", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to move room to front: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
+}
+
+type flushQueueRequest struct {
+	ConfirmToken string `json:"confirm_token"`
+}
+
+// FlushQueue empties the queue in two steps: without a body it returns a
+// confirmation token, posting that token back performs the flush
+func (h *AdminHandler) FlushQueue(w http.ResponseWriter, r *http.Request) {
+	var req flushQueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		log.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if req.ConfirmToken == "" {
+		token, err := h.allocationUsecase.RequestQueueFlush()
+		if err != nil {
+			log.Printf("Failed to request queue flush: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":        "confirmation_required",
+			"confirm_token": token,
+			"message":       "Post the confirm_token within a minute to flush the queue",
+		})
+		return
+	}
+
+	count, err := h.allocationUsecase.FlushQueue(req.ConfirmToken)
+	if errors.Is(err, usecase.ErrInvalidFlushToken) {
+		http.Error(w, "Invalid or expired confirm_token", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to flush queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Queue flushed from %s, %d items dropped", r.RemoteAddr, count)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "flushed",
+		"count":  count,
+	})
+}
+
+type assignRoomRequest struct {
+	AgentID string `json:"agent_id"`
+	Actor   string `json:"actor"`
+}
+
+// AssignRoom assigns a room to an agent, taking it over from any agent serving it
+func (h *AdminHandler) AssignRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+
+	var req assignRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if req.AgentID == "" || req.Actor == "" {
+		http.Error(w, "agent_id and actor are required", http.StatusBadRequest)
+		return
+	}
+
+	assignment, err := h.allocationUsecase.ManualAssign(roomID, req.AgentID, req.Actor, r.RemoteAddr)
+	if errors.Is(err, usecase.ErrAlreadyAssigned) {
+		http.Error(w, "Room already assigned to this agent", http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to manually assign room %s: %v", roomID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(assignment)
+}
+
+// defaultAuditLimit and maxAuditLimit bound the audit entries returned at once
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ListAuditLog returns the most recent audited admin actions, newest first
+func (h *AdminHandler) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	entries, err := h.allocationUsecase.ListAuditLog(limit)
+	if err != nil {
+		log.Printf("Failed to list audit log: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
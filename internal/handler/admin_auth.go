@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// NewAdminAuth returns a middleware that requires "Authorization: Bearer <token>".
+// A token is required so the admin API is never left open.
+func NewAdminAuth(token string) (func(http.Handler) http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("admin token is required")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				log.Printf("Rejected admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
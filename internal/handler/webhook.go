@@ -8,16 +8,21 @@ import (
 	"time"
 
 	"qiscus-agent-allocation/internal/domain/entity"
+	"qiscus-agent-allocation/internal/service"
 	"qiscus-agent-allocation/internal/usecase"
 )
 
 type WebhookHandler struct {
 	allocationUsecase usecase.AllocationUsecase
+	notifier          *service.NotifierService
 }
 
-func NewWebhookHandler(allocationUsecase usecase.AllocationUsecase) *WebhookHandler {
+// NewWebhookHandler creates the webhook handler. notifier may be nil when
+// queue position messages are disabled.
+func NewWebhookHandler(allocationUsecase usecase.AllocationUsecase, notifier *service.NotifierService) *WebhookHandler {
 	return &WebhookHandler{
 		allocationUsecase: allocationUsecase,
+		notifier:          notifier,
 	}
 }
 
@@ -62,7 +67,7 @@ func (h *WebhookHandler) HandleIncoming(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// 4. Add to Redis Queue (FIFO with timestamp)
+	// 4. Add to Redis Queue (priority, then FIFO by timestamp)
 	queueItem := entity.QueueItem{
 		CustomerID: webhook.Email,
 		RoomID:     webhook.RoomID,
@@ -70,6 +75,11 @@ func (h *WebhookHandler) HandleIncoming(w http.ResponseWriter, r *http.Request)
 		Timestamp:  time.Now(),
 	}
 
+	// Keep Qiscus's suggested agent so the worker can try them first
+	if webhook.CandidateAgent != nil && webhook.CandidateAgent.ID > 0 {
+		queueItem.CandidateAgentID = fmt.Sprintf("%d", webhook.CandidateAgent.ID)
+	}
+
 	err = h.allocationUsecase.AddToQueue(queueItem)
 	if err != nil {
 		log.Printf("Failed to add to queue: %v", err)
@@ -77,6 +87,11 @@ func (h *WebhookHandler) HandleIncoming(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Tell the customer their place in the queue
+	if h.notifier != nil {
+		h.notifier.Enqueued(queueItem)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -108,21 +123,48 @@ func (h *WebhookHandler) HandleResolved(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// 3. Update Agent Capacity (Redis -1) if agent exists
+	response := map[string]interface{}{
+		"status":  "resolved",
+		"message": "Chat resolved successfully",
+	}
+
+	// Both steps are idempotent, so a failure is reported for the sender to
+	// retry the whole webhook, after trying the other step anyway
+	failed := false
+
+	// 3. Drop the room from the queue in case it was resolved while waiting
+	removed, err := h.allocationUsecase.DropResolvedRoom(webhook.Service.RoomID)
+	if err != nil {
+		log.Printf("Failed to drop resolved room from queue: %v", err)
+		failed = true
+	} else if removed > 0 {
+		response["removed_from_queue"] = removed
+		log.Printf("Removed resolved room %s from queue", webhook.Service.RoomID)
+	}
+
+	// 4. Free the room from the agent holding it (idempotent per room)
+	resolvedBy := ""
 	if webhook.ResolvedBy.ID > 0 {
-		agentID := fmt.Sprintf("%d", webhook.ResolvedBy.ID)
-		err := h.allocationUsecase.DecrementAgentCapacity(agentID)
-		if err != nil {
-			log.Printf("Failed to decrement agent capacity: %v", err)
-		}
-		log.Printf("Chat resolved: Room %s, Agent %s (%s)",
-			webhook.Service.RoomID, agentID, webhook.ResolvedBy.Name)
+		resolvedBy = fmt.Sprintf("%d", webhook.ResolvedBy.ID)
+	}
+
+	agentID, capacity, err := h.allocationUsecase.ResolveRoom(webhook.Service.RoomID, resolvedBy)
+	if err != nil {
+		log.Printf("Failed to release agent slot: %v", err)
+		failed = true
+	} else if agentID != "" {
+		response["agent_id"] = agentID
+		response["agent_capacity"] = capacity
+		log.Printf("Chat resolved: Room %s, Agent %s (resolved by %s), current capacity %d",
+			webhook.Service.RoomID, agentID, webhook.ResolvedBy.Name, capacity)
+	}
+
+	if failed {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "resolved",
-		"message": "Chat resolved successfully",
-	})
+	json.NewEncoder(w).Encode(response)
 }
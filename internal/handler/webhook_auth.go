@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiscus-agent-allocation/internal/repository/redis"
+)
+
+const (
+	WebhookAuthNone   = "none"
+	WebhookAuthSecret = "secret"
+	WebhookAuthHMAC   = "hmac"
+)
+
+// maxWebhookBody limits how much of a webhook body is read for signing
+const maxWebhookBody = 1 << 20
+
+// errNonceStore marks a request that couldn't be checked for replay, as
+// opposed to one that failed authentication
+var errNonceStore = errors.New("failed to claim nonce")
+
+type WebhookAuthConfig struct {
+	// Mode is none, secret (shared secret header) or hmac (body signature).
+	// Empty picks secret when a secret is set, otherwise none.
+	Mode            string
+	Secret          string
+	SecretHeader    string
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+	// ReplayWindow is how old a request may be, 0 disables timestamp and nonce checks
+	ReplayWindow time.Duration
+}
+
+// NewWebhookAuth returns a middleware that rejects webhooks without a valid
+// shared secret or HMAC-SHA256 signature. With a replay window, requests must
+// carry a recent unix timestamp and a nonce that was not seen before; in hmac
+// mode both are covered by the signature of "timestamp.nonce.body". A nonce is
+// given back when the handler fails with a 5xx, so the sender can retry.
+func NewWebhookAuth(config WebhookAuthConfig, nonces redis.NonceRepository) (func(http.Handler) http.Handler, error) {
+	if config.Mode == "" {
+		config.Mode = WebhookAuthNone
+		if config.Secret != "" {
+			config.Mode = WebhookAuthSecret
+		}
+	}
+
+	switch config.Mode {
+	case WebhookAuthNone:
+		// A configured secret means webhooks were meant to be authenticated
+		if config.Secret != "" {
+			return nil, fmt.Errorf("webhook auth mode %s would ignore the configured secret", config.Mode)
+		}
+		log.Println("Warning: webhook authentication is disabled")
+		return func(next http.Handler) http.Handler { return next }, nil
+	case WebhookAuthSecret, WebhookAuthHMAC:
+	default:
+		return nil, fmt.Errorf("unknown webhook auth mode %q", config.Mode)
+	}
+
+	if config.Secret == "" {
+		return nil, fmt.Errorf("webhook auth mode %s requires a secret", config.Mode)
+	}
+
+	auth := &webhookAuth{config: config, nonces: nonces}
+	return auth.middleware, nil
+}
+
+type webhookAuth struct {
+	config WebhookAuthConfig
+	nonces redis.NonceRepository
+}
+
+func (a *webhookAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			log.Printf("Failed to read webhook body: %v", err)
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+		// Let the handler decode the body again
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		err = a.verify(r, body)
+		if errors.Is(err, errNonceStore) {
+			// Let the sender retry once Redis is back
+			log.Printf("Failed to check webhook %s for replay: %v", r.URL.Path, err)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Printf("Rejected webhook %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if a.config.ReplayWindow <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= http.StatusInternalServerError {
+			nonce := r.Header.Get(a.config.NonceHeader)
+			if err := a.nonces.Release(nonce); err != nil {
+				log.Printf("Failed to release nonce of failed webhook %s: %v", r.URL.Path, err)
+			}
+		}
+	})
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (a *webhookAuth) verify(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(a.config.TimestampHeader)
+	nonce := r.Header.Get(a.config.NonceHeader)
+
+	if a.config.ReplayWindow > 0 {
+		if err := a.checkTimestamp(timestamp); err != nil {
+			return err
+		}
+
+		if nonce == "" {
+			return fmt.Errorf("missing %s header", a.config.NonceHeader)
+		}
+	}
+
+	switch a.config.Mode {
+	case WebhookAuthSecret:
+		secret := r.Header.Get(a.config.SecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(a.config.Secret)) != 1 {
+			return fmt.Errorf("invalid %s header", a.config.SecretHeader)
+		}
+	case WebhookAuthHMAC:
+		if err := a.checkSignature(r.Header.Get(a.config.SignatureHeader), timestamp, nonce, body); err != nil {
+			return err
+		}
+	}
+
+	// Claim the nonce last so unauthenticated requests can't burn nonces
+	if a.config.ReplayWindow > 0 {
+		claimed, err := a.nonces.Claim(nonce, 2*a.config.ReplayWindow)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errNonceStore, err)
+		}
+
+		if !claimed {
+			return fmt.Errorf("replayed nonce %q", nonce)
+		}
+	}
+
+	return nil
+}
+
+// checkTimestamp accepts unix timestamps within the replay window either way
+func (a *webhookAuth) checkTimestamp(timestamp string) error {
+	if timestamp == "" {
+		return fmt.Errorf("missing %s header", a.config.TimestampHeader)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header %q", a.config.TimestampHeader, timestamp)
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > a.config.ReplayWindow || age < -a.config.ReplayWindow {
+		return fmt.Errorf("timestamp %s outside replay window", timestamp)
+	}
+
+	return nil
+}
+
+// checkSignature compares the hex HMAC-SHA256 signature, optionally prefixed
+// with "sha256=", against the body (and timestamp and nonce when replay
+// protection is on)
+func (a *webhookAuth) checkSignature(signature, timestamp, nonce string, body []byte) error {
+	signature = strings.TrimPrefix(signature, "sha256=")
+	if signature == "" {
+		return fmt.Errorf("missing %s header", a.config.SignatureHeader)
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", a.config.SignatureHeader)
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.config.Secret))
+	if a.config.ReplayWindow > 0 {
+		mac.Write([]byte(timestamp + "." + nonce + "."))
+	}
+	mac.Write(body)
+
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNonces is an in-memory NonceRepository, failing every claim with err if set
+type fakeNonces struct {
+	claimed map[string]time.Duration
+	err     error
+}
+
+func newFakeNonces() *fakeNonces {
+	return &fakeNonces{claimed: make(map[string]time.Duration)}
+}
+
+func (f *fakeNonces) Claim(nonce string, ttl time.Duration) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	if _, ok := f.claimed[nonce]; ok {
+		return false, nil
+	}
+	f.claimed[nonce] = ttl
+	return true, nil
+}
+
+func (f *fakeNonces) Release(nonce string) error {
+	delete(f.claimed, nonce)
+	return nil
+}
+
+const (
+	testSecret = "s3cret"
+	testBody   = `{"room_id":"123"}`
+)
+
+func testAuthConfig(mode string, replayWindow time.Duration) WebhookAuthConfig {
+	return WebhookAuthConfig{
+		Mode:            mode,
+		Secret:          testSecret,
+		SecretHeader:    "X-Webhook-Secret",
+		SignatureHeader: "X-Webhook-Signature",
+		TimestampHeader: "X-Webhook-Timestamp",
+		NonceHeader:     "X-Webhook-Nonce",
+		ReplayWindow:    replayWindow,
+	}
+}
+
+func sign(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func timestamp(offset time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+}
+
+// serve runs the request through the middleware in front of a handler that
+// echoes the body with the given status
+func serve(t *testing.T, config WebhookAuthConfig, nonces *fakeNonces, status int, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	middleware, err := NewWebhookAuth(config, nonces)
+	if err != nil {
+		t.Fatalf("NewWebhookAuth: %v", err)
+	}
+
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/incoming", strings.NewReader(testBody))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewWebhookAuthConfig(t *testing.T) {
+	if _, err := NewWebhookAuth(WebhookAuthConfig{Mode: "basic", Secret: testSecret}, newFakeNonces()); err == nil {
+		t.Error("unknown mode: want error")
+	}
+
+	for _, mode := range []string{WebhookAuthSecret, WebhookAuthHMAC} {
+		if _, err := NewWebhookAuth(WebhookAuthConfig{Mode: mode}, newFakeNonces()); err == nil {
+			t.Errorf("%s without secret: want error", mode)
+		}
+	}
+
+	if _, err := NewWebhookAuth(WebhookAuthConfig{Mode: WebhookAuthNone, Secret: testSecret}, newFakeNonces()); err == nil {
+		t.Error("none with secret: want error")
+	}
+
+	rec := serve(t, WebhookAuthConfig{Mode: WebhookAuthNone}, newFakeNonces(), http.StatusOK, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("none mode: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = serve(t, WebhookAuthConfig{}, newFakeNonces(), http.StatusOK, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("default without secret: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Defaults to secret mode once a secret is set
+	rec = serve(t, testAuthConfig("", 0), newFakeNonces(), http.StatusOK, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("default with secret, no header: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = serve(t, testAuthConfig("", 0), newFakeNonces(), http.StatusOK, map[string]string{"X-Webhook-Secret": testSecret})
+	if rec.Code != http.StatusOK {
+		t.Errorf("default with secret, valid header: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestWebhookAuthSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		want   int
+	}{
+		{"valid secret", testSecret, http.StatusOK},
+		{"wrong secret", "guess", http.StatusUnauthorized},
+		{"secret prefix", testSecret[:3], http.StatusUnauthorized},
+		{"missing secret", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		headers := map[string]string{}
+		if tt.secret != "" {
+			headers["X-Webhook-Secret"] = tt.secret
+		}
+
+		rec := serve(t, testAuthConfig(WebhookAuthSecret, 0), newFakeNonces(), http.StatusOK, headers)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestWebhookAuthHMAC(t *testing.T) {
+	signature := sign(testSecret, testBody)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"valid signature", signature, http.StatusOK},
+		{"sha256 prefix", "sha256=" + signature, http.StatusOK},
+		{"upper case hex", strings.ToUpper(signature), http.StatusOK},
+		{"wrong secret", sign("other", testBody), http.StatusUnauthorized},
+		{"other body", sign(testSecret, `{"room_id":"456"}`), http.StatusUnauthorized},
+		{"not hex", "not-a-signature", http.StatusUnauthorized},
+		{"prefix only", "sha256=", http.StatusUnauthorized},
+		{"missing signature", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		headers := map[string]string{}
+		if tt.signature != "" {
+			headers["X-Webhook-Signature"] = tt.signature
+		}
+
+		rec := serve(t, testAuthConfig(WebhookAuthHMAC, 0), newFakeNonces(), http.StatusOK, headers)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestWebhookAuthPassesBody(t *testing.T) {
+	headers := map[string]string{"X-Webhook-Signature": sign(testSecret, testBody)}
+
+	rec := serve(t, testAuthConfig(WebhookAuthHMAC, 0), newFakeNonces(), http.StatusOK, headers)
+	if rec.Body.String() != testBody {
+		t.Errorf("handler read body %q, want %q", rec.Body.String(), testBody)
+	}
+}
+
+func TestWebhookAuthReplayWindow(t *testing.T) {
+	window := 5 * time.Minute
+
+	tests := []struct {
+		name      string
+		timestamp string
+		nonce     string
+		signed    string
+		want      int
+	}{
+		{"fresh request", timestamp(0), "n1", "", http.StatusOK},
+		{"old but within window", timestamp(-4 * time.Minute), "n1", "", http.StatusOK},
+		{"ahead but within window", timestamp(4 * time.Minute), "n1", "", http.StatusOK},
+		{"too old", timestamp(-6 * time.Minute), "n1", "", http.StatusUnauthorized},
+		{"too far ahead", timestamp(6 * time.Minute), "n1", "", http.StatusUnauthorized},
+		{"invalid timestamp", "yesterday", "n1", "", http.StatusUnauthorized},
+		{"missing timestamp", "", "n1", "", http.StatusUnauthorized},
+		{"missing nonce", timestamp(0), "", "", http.StatusUnauthorized},
+		{"signature without timestamp and nonce", timestamp(0), "n1", testBody, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		signed := tt.signed
+		if signed == "" {
+			signed = tt.timestamp + "." + tt.nonce + "." + testBody
+		}
+
+		headers := map[string]string{"X-Webhook-Signature": sign(testSecret, signed)}
+		if tt.timestamp != "" {
+			headers["X-Webhook-Timestamp"] = tt.timestamp
+		}
+		if tt.nonce != "" {
+			headers["X-Webhook-Nonce"] = tt.nonce
+		}
+
+		rec := serve(t, testAuthConfig(WebhookAuthHMAC, window), newFakeNonces(), http.StatusOK, headers)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestWebhookAuthNonceReuse(t *testing.T) {
+	config := testAuthConfig(WebhookAuthHMAC, 5*time.Minute)
+	nonces := newFakeNonces()
+
+	ts := timestamp(0)
+	valid := map[string]string{
+		"X-Webhook-Timestamp": ts,
+		"X-Webhook-Nonce":     "n1",
+		"X-Webhook-Signature": sign(testSecret, ts+".n1."+testBody),
+	}
+	forged := map[string]string{
+		"X-Webhook-Timestamp": ts,
+		"X-Webhook-Nonce":     "n1",
+		"X-Webhook-Signature": sign("other", ts+".n1."+testBody),
+	}
+
+	// A rejected request must not burn the nonce
+	if rec := serve(t, config, nonces, http.StatusOK, forged); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("forged request: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	if rec := serve(t, config, nonces, http.StatusOK, valid); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if ttl := nonces.claimed["n1"]; ttl != 10*time.Minute {
+		t.Errorf("nonce ttl %s, want twice the replay window", ttl)
+	}
+
+	if rec := serve(t, config, nonces, http.StatusOK, valid); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWebhookAuthNonceAfterHandlerStatus(t *testing.T) {
+	config := testAuthConfig(WebhookAuthSecret, 5*time.Minute)
+
+	tests := []struct {
+		name       string
+		status     int
+		retryAllow bool
+	}{
+		{"handler succeeded", http.StatusOK, false},
+		{"handler rejected payload", http.StatusBadRequest, false},
+		{"handler failed", http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		nonces := newFakeNonces()
+		headers := map[string]string{
+			"X-Webhook-Secret":    testSecret,
+			"X-Webhook-Timestamp": timestamp(0),
+			"X-Webhook-Nonce":     "n1",
+		}
+
+		if rec := serve(t, config, nonces, tt.status, headers); rec.Code != tt.status {
+			t.Fatalf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+
+		rec := serve(t, config, nonces, http.StatusOK, headers)
+		if allowed := rec.Code == http.StatusOK; allowed != tt.retryAllow {
+			t.Errorf("%s: retry status %d, want retry allowed %v", tt.name, rec.Code, tt.retryAllow)
+		}
+	}
+}
+
+func TestWebhookAuthNonceStoreDown(t *testing.T) {
+	nonces := newFakeNonces()
+	nonces.err = errors.New("connection refused")
+
+	headers := map[string]string{
+		"X-Webhook-Secret":    testSecret,
+		"X-Webhook-Timestamp": timestamp(0),
+		"X-Webhook-Nonce":     "n1",
+	}
+
+	rec := serve(t, testAuthConfig(WebhookAuthSecret, 5*time.Minute), nonces, http.StatusOK, headers)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
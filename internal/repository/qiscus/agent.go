@@ -2,6 +2,7 @@ package qiscus
 
 import (
 	"fmt"
+	"strconv"
 
 	"qiscus-agent-allocation/internal/domain/entity"
 	"qiscus-agent-allocation/pkg/qiscus"
@@ -9,7 +10,12 @@ import (
 
 type AgentQiscusRepository interface {
 	GetOnlineAgents() ([]entity.QiscusAgent, error)
+	GetOnlineAgentsByDivision(divisionIDs []int) ([]entity.QiscusAgent, error)
+	GetAllAgents() ([]entity.QiscusAgent, error)
+	GetActiveRooms(agentID string) ([]string, error)
 	AssignAgent(roomID, agentID string) error
+	ReassignAgent(roomID, agentID string) error
+	SendMessage(roomID, message string) error
 }
 
 type agentQiscusRepository struct {
@@ -45,6 +51,56 @@ func (r *agentQiscusRepository) GetOnlineAgents() ([]entity.QiscusAgent, error)
 	return onlineAgents, nil
 }
 
+// GetOnlineAgentsByDivision fetches online agents of the given divisions from Qiscus API
+func (r *agentQiscusRepository) GetOnlineAgentsByDivision(divisionIDs []int) ([]entity.QiscusAgent, error) {
+	agents, err := r.client.GetAgentsByDivision(divisionIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get division agents from Qiscus: %w", err)
+	}
+
+	// Filter only online agents
+	var onlineAgents []entity.QiscusAgent
+	for _, agent := range agents {
+		if agent.IsAvailable {
+			onlineAgents = append(onlineAgents, agent)
+		}
+	}
+
+	return onlineAgents, nil
+}
+
+// GetAllAgents fetches all agents, online or not, from Qiscus API
+func (r *agentQiscusRepository) GetAllAgents() ([]entity.QiscusAgent, error) {
+	agents, err := r.client.GetAgents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agents from Qiscus: %w", err)
+	}
+
+	return agents, nil
+}
+
+// GetActiveRooms fetches room IDs of unresolved chats served by the agent
+func (r *agentQiscusRepository) GetActiveRooms(agentID string) ([]string, error) {
+	id, err := strconv.Atoi(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent id %q: %w", agentID, err)
+	}
+
+	customerRooms, err := r.client.GetAgentActiveRooms(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active rooms from Qiscus: %w", err)
+	}
+
+	var rooms []string
+	for _, room := range customerRooms {
+		if !room.IsResolved {
+			rooms = append(rooms, room.RoomID)
+		}
+	}
+
+	return rooms, nil
+}
+
 // AssignAgent assigns an agent to a room via Qiscus API
 func (r *agentQiscusRepository) AssignAgent(roomID, agentID string) error {
 	// Call Qiscus API to assign agent
@@ -55,3 +111,21 @@ func (r *agentQiscusRepository) AssignAgent(roomID, agentID string) error {
 
 	return nil
 }
+
+// ReassignAgent moves a room to another agent via Qiscus API
+func (r *agentQiscusRepository) ReassignAgent(roomID, agentID string) error {
+	if err := r.client.ReassignAgent(roomID, agentID); err != nil {
+		return fmt.Errorf("failed to reassign agent via Qiscus API: %w", err)
+	}
+
+	return nil
+}
+
+// SendMessage posts a bot message to a room via Qiscus API
+func (r *agentQiscusRepository) SendMessage(roomID, message string) error {
+	if err := r.client.SendMessage(roomID, message); err != nil {
+		return fmt.Errorf("failed to send message via Qiscus API: %w", err)
+	}
+
+	return nil
+}
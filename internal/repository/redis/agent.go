@@ -2,98 +2,512 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
 const (
-	AgentsKey = "agents"
+	AgentsKey           = "agents"
+	AgentMaxCapacityKey = "agent_max_capacity"
+	AgentSkillsKey      = "agent_skills"
+	RoomAgentsKey       = "room_agents"
+	RoomReservedKey     = "room_reserved_at"
+	LastAssignedKey     = "agent_last_assigned"
+	RoundRobinKey       = "allocation:round_robin"
+	CustomerAgentKey    = "customer_agent"
+	AssignmentsKey      = "allocation:assignments"
 )
 
+// ErrRoomClosed is returned by ReserveSlot when the room was resolved or
+// assigned outside the queue after it was queued
+var ErrRoomClosed = errors.New("room was closed after it was queued")
+
+// assignmentsRetention is how long assignments are kept for throughput estimates
+const assignmentsRetention = time.Hour
+
+// reserveSlotScript adds the room to the agent's active rooms only while the
+// agent holds fewer rooms than the max, and records the room -> agent mapping,
+// the room's reservation time and the agent's last assignment time. Returns -1
+// without reserving when the room was closed (KEYS[5]) at or after the time
+// it was queued (ARGV[5]).
+var reserveSlotScript = redis.NewScript(`
+local closedAt = tonumber(redis.call('GET', KEYS[5]) or '0')
+if closedAt > 0 and closedAt >= tonumber(ARGV[5]) then
+	return -1
+end
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+if redis.call('SCARD', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('SADD', KEYS[1], ARGV[1])
+	redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+	redis.call('HSET', KEYS[3], ARGV[3], ARGV[4])
+	redis.call('HSET', KEYS[4], ARGV[1], ARGV[4])
+	return 1
+end
+return 0
+`)
+
+// releaseSlotScript removes the room from the agent's active rooms, drops the
+// mapping if it still points to the agent, and returns the agent's new load.
+// Releasing a room the agent doesn't hold is a no-op.
+var releaseSlotScript = redis.NewScript(`
+redis.call('SREM', KEYS[1], ARGV[1])
+if redis.call('HGET', KEYS[2], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('HDEL', KEYS[3], ARGV[1])
+end
+return redis.call('SCARD', KEYS[1])
+`)
+
+// correctRoomsScript applies a reconciliation diff to the agent's active
+// rooms. ARGV[1] is the agent ID, ARGV[2] the reservation cutoff, ARGV[3] the
+// time the diff's snapshot was taken and ARGV[4] the number of rooms to
+// remove, followed by those rooms and then the rooms to add. A room is only
+// removed if it is still held and wasn't reserved after the cutoff, since the
+// worker reserves before Qiscus shows the assignment. A room is only added if
+// it wasn't closed after the snapshot (KEYS[3 + i] is the closed marker of
+// the i-th room to add). Returns the removed rooms, the added rooms and the
+// agent's new load.
+var correctRoomsScript = redis.NewScript(`
+local removeCount = tonumber(ARGV[4])
+local removed, added = {}, {}
+for i = 5, 4 + removeCount do
+	local room = ARGV[i]
+	local reservedAt = tonumber(redis.call('HGET', KEYS[3], room) or '0')
+	if reservedAt <= tonumber(ARGV[2]) and redis.call('SREM', KEYS[1], room) == 1 then
+		if redis.call('HGET', KEYS[2], room) == ARGV[1] then
+			redis.call('HDEL', KEYS[2], room)
+			redis.call('HDEL', KEYS[3], room)
+		end
+		table.insert(removed, room)
+	end
+end
+for i = 5 + removeCount, #ARGV do
+	local room = ARGV[i]
+	local closedAt = tonumber(redis.call('GET', KEYS[i - removeCount - 1]) or '0')
+	if closedAt < tonumber(ARGV[3]) and redis.call('SADD', KEYS[1], room) == 1 then
+		redis.call('HSET', KEYS[2], room, ARGV[1])
+		table.insert(added, room)
+	end
+end
+return {removed, added, redis.call('SCARD', KEYS[1])}
+`)
+
+// moveRoomScript moves the room to the agent's active rooms from the
+// previous agent's (KEYS[4], if any) regardless of capacity. Returns -1 when
+// the room's agent is no longer ARGV[3], otherwise the agent's new load.
+var moveRoomScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[2], ARGV[1]) or ''
+if current ~= ARGV[3] then
+	return -1
+end
+if KEYS[4] then
+	redis.call('SREM', KEYS[4], ARGV[1])
+end
+redis.call('SADD', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[4])
+return redis.call('SCARD', KEYS[1])
+`)
+
 type AgentRepository interface {
 	GetCapacity(agentID string) (int, error)
-	IncrementCapacity(agentID string) error
-	DecrementCapacity(agentID string) error
+	GetRooms(agentID string) ([]string, error)
+	GetRoomAgent(roomID string) (string, error)
+	ReserveSlot(agentID, roomID string, maxCapacity int, queuedAt time.Time) (bool, error)
+	ReleaseSlot(agentID, roomID string) (int, error)
+	CorrectRooms(agentID string, remove, add []string, snapshotAt, reservedBefore time.Time) (*RoomsCorrection, error)
+	MoveRoom(roomID, fromAgentID, toAgentID string) (int, bool, error)
+	GetLastAssigned(agentIDs []string) (map[string]int64, error)
+	NextRoundRobin() (int64, error)
+	RecordAssignment(roomID string) error
+	CountAssignmentsSince(since time.Time) (int64, error)
+	GetCustomerAgent(customerID string) (string, error)
+	SetCustomerAgent(customerID, agentID string, ttl time.Duration) error
+
+	// Max capacity operations
+	GetMaxCapacity(agentID string) (int, error)
+	SetMaxCapacity(agentID string, maxCapacity int) error
+	ResetMaxCapacity(agentID string) error
+	GetDefaultMaxCapacity() int
+
+	// Skill operations
+	GetSkills(agentID string) ([]string, error)
+	SetSkills(agentID string, skills []string) error
 }
 
 type agentRepository struct {
-	client *redis.Client
+	client             *redis.Client
+	defaultMaxCapacity int
 }
 
-func NewAgentRepository(client *redis.Client) AgentRepository {
+func NewAgentRepository(client *redis.Client, defaultMaxCapacity int) AgentRepository {
 	return &agentRepository{
-		client: client,
+		client:             client,
+		defaultMaxCapacity: defaultMaxCapacity,
 	}
 }
 
-// getAgentKey returns Redis key for agent capacity
-func (r *agentRepository) getAgentKey(agentID string) string {
-	return fmt.Sprintf("%s:%s", AgentsKey, agentID)
+// getRoomsKey returns Redis key for the set of rooms an agent holds
+func (r *agentRepository) getRoomsKey(agentID string) string {
+	return fmt.Sprintf("%s:%s:rooms", AgentsKey, agentID)
+}
+
+// getSkillsKey returns Redis key for the set of channels an agent serves
+func (r *agentRepository) getSkillsKey(agentID string) string {
+	return fmt.Sprintf("%s:%s", AgentSkillsKey, agentID)
+}
+
+// getMaxCapacityKey returns Redis key for agent max capacity
+func (r *agentRepository) getMaxCapacityKey(agentID string) string {
+	return fmt.Sprintf("%s:%s", AgentMaxCapacityKey, agentID)
 }
 
 // GetCapacity gets current number of customers assigned to agent
 func (r *agentRepository) GetCapacity(agentID string) (int, error) {
 	ctx := context.Background()
-	key := r.getAgentKey(agentID)
+	key := r.getRoomsKey(agentID)
 
-	// Get current capacity value
-	result := r.client.Get(ctx, key)
+	// Capacity is the number of active rooms, 0 if the set doesn't exist
+	capacity, err := r.client.SCard(ctx, key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get agent capacity: %w", err)
+	}
+
+	return int(capacity), nil
+}
+
+// GetRooms gets the rooms currently assigned to agent
+func (r *agentRepository) GetRooms(agentID string) ([]string, error) {
+	ctx := context.Background()
+	key := r.getRoomsKey(agentID)
 
-	// If key doesn't exist, capacity is 0
+	rooms, err := r.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent rooms: %w", err)
+	}
+
+	return rooms, nil
+}
+
+// GetRoomAgent gets the agent holding a room, empty if the room isn't tracked
+func (r *agentRepository) GetRoomAgent(roomID string) (string, error) {
+	ctx := context.Background()
+
+	result := r.client.HGet(ctx, RoomAgentsKey, roomID)
 	if result.Err() == redis.Nil {
-		return 0, nil
+		return "", nil
 	}
 
 	if result.Err() != nil {
-		return 0, fmt.Errorf("failed to get agent capacity: %w", result.Err())
+		return "", fmt.Errorf("failed to get room agent: %w", result.Err())
+	}
+
+	return result.Val(), nil
+}
+
+// ReserveSlot atomically assigns the room to the agent if its load is below
+// maxCapacity. Returns ErrRoomClosed if the room was closed after queuedAt.
+func (r *agentRepository) ReserveSlot(agentID, roomID string, maxCapacity int, queuedAt time.Time) (bool, error) {
+	ctx := context.Background()
+	keys := []string{r.getRoomsKey(agentID), RoomAgentsKey, LastAssignedKey, RoomReservedKey, ClosedKeyPrefix + roomID}
+
+	result, err := reserveSlotScript.Run(ctx, r.client, keys,
+		roomID, maxCapacity, agentID, time.Now().UnixMilli(), queuedAt.UnixMilli()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve agent slot: %w", err)
 	}
 
-	// Convert string to int
-	capacity, err := strconv.Atoi(result.Val())
+	if result == -1 {
+		return false, ErrRoomClosed
+	}
+
+	return result == 1, nil
+}
+
+// ReleaseSlot atomically removes the room from the agent and returns the agent's new load
+func (r *agentRepository) ReleaseSlot(agentID, roomID string) (int, error) {
+	ctx := context.Background()
+	keys := []string{r.getRoomsKey(agentID), RoomAgentsKey, RoomReservedKey}
+
+	capacity, err := releaseSlotScript.Run(ctx, r.client, keys, roomID, agentID).Int()
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse capacity value: %w", err)
+		return 0, fmt.Errorf("failed to release agent slot: %w", err)
 	}
 
 	return capacity, nil
 }
 
-// IncrementCapacity increases agent's customer count by 1
-func (r *agentRepository) IncrementCapacity(agentID string) error {
+// RoomsCorrection is what CorrectRooms actually changed
+type RoomsCorrection struct {
+	Removed []string
+	Added   []string
+	Load    int
+}
+
+// CorrectRooms removes and adds rooms found by comparing a snapshot of the
+// agent's rooms taken at snapshotAt with Qiscus. Rooms reserved after
+// reservedBefore are kept and rooms closed after snapshotAt aren't added,
+// so assignments and resolutions that race with reconciliation win.
+func (r *agentRepository) CorrectRooms(agentID string, remove, add []string, snapshotAt, reservedBefore time.Time) (*RoomsCorrection, error) {
 	ctx := context.Background()
-	key := r.getAgentKey(agentID)
 
-	// Use INCR to atomically increment the counter
-	// If key doesn't exist, it will be set to 1
-	err := r.client.Incr(ctx, key).Err()
+	keys := make([]string, 0, len(add)+3)
+	keys = append(keys, r.getRoomsKey(agentID), RoomAgentsKey, RoomReservedKey)
+	for _, room := range add {
+		keys = append(keys, ClosedKeyPrefix+room)
+	}
+
+	args := make([]interface{}, 0, len(remove)+len(add)+4)
+	args = append(args, agentID, reservedBefore.UnixMilli(), snapshotAt.UnixMilli(), len(remove))
+	for _, room := range remove {
+		args = append(args, room)
+	}
+	for _, room := range add {
+		args = append(args, room)
+	}
+
+	result, err := correctRoomsScript.Run(ctx, r.client, keys, args...).Slice()
 	if err != nil {
-		return fmt.Errorf("failed to increment agent capacity: %w", err)
+		return nil, fmt.Errorf("failed to correct agent rooms: %w", err)
+	}
+
+	if len(result) != 3 {
+		return nil, fmt.Errorf("unexpected correct rooms result: %v", result)
+	}
+
+	load, _ := result[2].(int64)
+	return &RoomsCorrection{
+		Removed: stringSlice(result[0]),
+		Added:   stringSlice(result[1]),
+		Load:    int(load),
+	}, nil
+}
+
+// stringSlice converts a script reply array to strings
+func stringSlice(value interface{}) []string {
+	values, _ := value.([]interface{})
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// MoveRoom atomically moves the room from fromAgentID (empty if no agent held
+// it) to toAgentID, ignoring capacity. Returns false when the room's agent is
+// no longer fromAgentID, otherwise the new load of toAgentID.
+func (r *agentRepository) MoveRoom(roomID, fromAgentID, toAgentID string) (int, bool, error) {
+	ctx := context.Background()
+	keys := []string{r.getRoomsKey(toAgentID), RoomAgentsKey, RoomReservedKey}
+	if fromAgentID != "" {
+		keys = append(keys, r.getRoomsKey(fromAgentID))
+	}
+
+	load, err := moveRoomScript.Run(ctx, r.client, keys, roomID, toAgentID, fromAgentID, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to move room: %w", err)
+	}
+
+	if load < 0 {
+		return 0, false, nil
+	}
+
+	return load, true, nil
+}
+
+// GetLastAssigned gets the last assignment time (unix ms) of each agent,
+// 0 for agents that were never assigned
+func (r *agentRepository) GetLastAssigned(agentIDs []string) (map[string]int64, error) {
+	ctx := context.Background()
+	lastAssigned := make(map[string]int64, len(agentIDs))
+
+	if len(agentIDs) == 0 {
+		return lastAssigned, nil
+	}
+
+	values, err := r.client.HMGet(ctx, LastAssignedKey, agentIDs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last assigned time: %w", err)
+	}
+
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			lastAssigned[agentIDs[i]] = 0
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse last assigned time: %w", err)
+		}
+		lastAssigned[agentIDs[i]] = timestamp
+	}
+
+	return lastAssigned, nil
+}
+
+// NextRoundRobin returns a counter shared by all instances for round-robin selection
+func (r *agentRepository) NextRoundRobin() (int64, error) {
+	ctx := context.Background()
+
+	next, err := r.client.Incr(ctx, RoundRobinKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to advance round robin: %w", err)
+	}
+
+	return next, nil
+}
+
+// RecordAssignment logs an assignment time for throughput estimates, keeping
+// the last assignmentsRetention of history
+func (r *agentRepository) RecordAssignment(roomID string) error {
+	ctx := context.Background()
+	now := time.Now()
+
+	pipe := r.client.TxPipeline()
+	pipe.ZAdd(ctx, AssignmentsKey, &redis.Z{Score: float64(now.UnixMilli()), Member: roomID})
+	pipe.ZRemRangeByScore(ctx, AssignmentsKey, "-inf", strconv.FormatInt(now.Add(-assignmentsRetention).UnixMilli(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record assignment: %w", err)
 	}
 
 	return nil
 }
 
-// DecrementCapacity decreases agent's customer count by 1
-func (r *agentRepository) DecrementCapacity(agentID string) error {
+// CountAssignmentsSince counts the assignments made after since
+func (r *agentRepository) CountAssignmentsSince(since time.Time) (int64, error) {
 	ctx := context.Background()
-	key := r.getAgentKey(agentID)
 
-	// Get current value first to avoid going below 0
-	current, err := r.GetCapacity(agentID)
+	count, err := r.client.ZCount(ctx, AssignmentsKey, strconv.FormatInt(since.UnixMilli(), 10), "+inf").Result()
 	if err != nil {
-		return fmt.Errorf("failed to get current capacity: %w", err)
+		return 0, fmt.Errorf("failed to count assignments: %w", err)
 	}
 
-	// Don't decrement if already at 0
-	if current <= 0 {
-		return nil
+	return count, nil
+}
+
+// GetCustomerAgent gets the agent who last served the customer, empty if unknown or expired
+func (r *agentRepository) GetCustomerAgent(customerID string) (string, error) {
+	ctx := context.Background()
+	key := fmt.Sprintf("%s:%s", CustomerAgentKey, customerID)
+
+	agentID, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get customer agent: %w", err)
+	}
+
+	return agentID, nil
+}
+
+// SetCustomerAgent remembers the agent who served the customer for ttl
+func (r *agentRepository) SetCustomerAgent(customerID, agentID string, ttl time.Duration) error {
+	ctx := context.Background()
+	key := fmt.Sprintf("%s:%s", CustomerAgentKey, customerID)
+
+	err := r.client.Set(ctx, key, agentID, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set customer agent: %w", err)
+	}
+
+	return nil
+}
+
+// GetMaxCapacity gets the max number of customers an agent can handle,
+// falling back to the default when no per-agent limit is stored
+func (r *agentRepository) GetMaxCapacity(agentID string) (int, error) {
+	ctx := context.Background()
+	key := r.getMaxCapacityKey(agentID)
+
+	result := r.client.Get(ctx, key)
+
+	// No per-agent limit, use the default
+	if result.Err() == redis.Nil {
+		return r.defaultMaxCapacity, nil
 	}
 
-	// Use DECR to atomically decrement the counter
-	err = r.client.Decr(ctx, key).Err()
+	if result.Err() != nil {
+		return 0, fmt.Errorf("failed to get agent max capacity: %w", result.Err())
+	}
+
+	maxCapacity, err := strconv.Atoi(result.Val())
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse max capacity value: %w", err)
+	}
+
+	return maxCapacity, nil
+}
+
+// SetMaxCapacity stores a per-agent max capacity
+func (r *agentRepository) SetMaxCapacity(agentID string, maxCapacity int) error {
+	ctx := context.Background()
+	key := r.getMaxCapacityKey(agentID)
+
+	err := r.client.Set(ctx, key, maxCapacity, 0).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set agent max capacity: %w", err)
+	}
+
+	return nil
+}
+
+// ResetMaxCapacity removes the per-agent max capacity so the default applies
+func (r *agentRepository) ResetMaxCapacity(agentID string) error {
+	ctx := context.Background()
+	key := r.getMaxCapacityKey(agentID)
+
+	err := r.client.Del(ctx, key).Err()
+	if err != nil {
+		return fmt.Errorf("failed to reset agent max capacity: %w", err)
+	}
+
+	return nil
+}
+
+// GetDefaultMaxCapacity returns the global max capacity used when no per-agent limit is set
+func (r *agentRepository) GetDefaultMaxCapacity() int {
+	return r.defaultMaxCapacity
+}
+
+// GetSkills gets the channels an agent serves, empty for generalists
+func (r *agentRepository) GetSkills(agentID string) ([]string, error) {
+	ctx := context.Background()
+	key := r.getSkillsKey(agentID)
+
+	skills, err := r.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent skills: %w", err)
+	}
+
+	return skills, nil
+}
+
+// SetSkills replaces the channels an agent serves. An empty list makes the agent a generalist.
+func (r *agentRepository) SetSkills(agentID string, skills []string) error {
+	ctx := context.Background()
+	key := r.getSkillsKey(agentID)
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		for _, skill := range skills {
+			pipe.SAdd(ctx, key, skill)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to decrement agent capacity: %w", err)
+		return fmt.Errorf("failed to set agent skills: %w", err)
 	}
 
 	return nil
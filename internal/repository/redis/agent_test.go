@@ -0,0 +1,122 @@
+package redis
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMoveRoom(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	agents := NewAgentRepository(client, 1)
+	now := time.Now()
+
+	for _, reserve := range []struct{ agent, room string }{{"a1", "r1"}, {"a2", "r2"}} {
+		if reserved, err := agents.ReserveSlot(reserve.agent, reserve.room, 1, now); err != nil || !reserved {
+			t.Fatalf("ReserveSlot(%s, %s) = %v, %v", reserve.agent, reserve.room, reserved, err)
+		}
+	}
+
+	// A manual assignment ignores the target's capacity
+	load, moved, err := agents.MoveRoom("r1", "a1", "a2")
+	if err != nil || !moved || load != 2 {
+		t.Fatalf("MoveRoom = %d, %v, %v, want 2, true", load, moved, err)
+	}
+	if rooms, _ := agents.GetRooms("a1"); len(rooms) != 0 {
+		t.Errorf("previous agent still holds %v", rooms)
+	}
+	if agent, _ := agents.GetRoomAgent("r1"); agent != "a2" {
+		t.Errorf("room agent = %q, want a2", agent)
+	}
+
+	// A move based on a stale agent is refused
+	if _, moved, err := agents.MoveRoom("r1", "a1", "a3"); err != nil || moved {
+		t.Errorf("MoveRoom from stale agent = %v, %v, want false", moved, err)
+	}
+	if count := client.SCard(ctx, "agents:a3:rooms").Val(); count != 0 {
+		t.Errorf("stale move gave a3 %d rooms", count)
+	}
+
+	// A room nobody holds is moved from no agent
+	if _, moved, err := agents.MoveRoom("r3", "", "a1"); err != nil || !moved {
+		t.Errorf("MoveRoom of untracked room = %v, %v, want true", moved, err)
+	}
+}
+
+func TestCorrectRooms(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	agents := NewAgentRepository(client, 5)
+	queue := NewQueueRepository(client, false, time.Minute)
+	now := time.Now()
+
+	for _, room := range []string{"stale", "fresh"} {
+		if reserved, err := agents.ReserveSlot("a1", room, 5, now); err != nil || !reserved {
+			t.Fatalf("ReserveSlot(%s) = %v, %v", room, reserved, err)
+		}
+	}
+	client.HSet(ctx, RoomReservedKey, "stale", now.Add(-10*time.Minute).UnixMilli())
+
+	// Resolved after the snapshot, and long before it
+	snapshotAt := now.Add(-time.Minute)
+	if err := queue.MarkClosed("resolved", now, time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+	if err := queue.MarkClosed("reopened", now.Add(-time.Hour), time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+
+	correction, err := agents.CorrectRooms("a1",
+		[]string{"stale", "fresh"}, []string{"missing", "resolved", "reopened"},
+		snapshotAt, now.Add(-5*time.Minute))
+	if err != nil {
+		t.Fatalf("CorrectRooms: %v", err)
+	}
+
+	// A room reserved within the grace period may not show in Qiscus yet
+	if len(correction.Removed) != 1 || correction.Removed[0] != "stale" {
+		t.Errorf("removed %v, want [stale]", correction.Removed)
+	}
+
+	sort.Strings(correction.Added)
+	if len(correction.Added) != 2 || correction.Added[0] != "missing" || correction.Added[1] != "reopened" {
+		t.Errorf("added %v, want [missing reopened]", correction.Added)
+	}
+
+	if correction.Load != 3 {
+		t.Errorf("load %d, want 3", correction.Load)
+	}
+	if agent, _ := agents.GetRoomAgent("stale"); agent != "" {
+		t.Errorf("removed room still mapped to %q", agent)
+	}
+	if agent, _ := agents.GetRoomAgent("missing"); agent != "a1" {
+		t.Errorf("added room mapped to %q, want a1", agent)
+	}
+}
+
+func TestReserveSlotClosedRoom(t *testing.T) {
+	client := newTestClient(t)
+	agents := NewAgentRepository(client, 5)
+	queue := NewQueueRepository(client, false, time.Minute)
+	queuedAt := time.Now().Add(-time.Minute)
+
+	if err := queue.MarkClosed("resolved", queuedAt.Add(time.Second), time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+	if err := queue.MarkClosed("reopened", queuedAt.Add(-time.Hour), time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+
+	if _, err := agents.ReserveSlot("a1", "resolved", 5, queuedAt); err != ErrRoomClosed {
+		t.Errorf("ReserveSlot of closed room: err %v, want %v", err, ErrRoomClosed)
+	}
+	if agent, _ := agents.GetRoomAgent("resolved"); agent != "" {
+		t.Errorf("closed room mapped to %q", agent)
+	}
+
+	if reserved, err := agents.ReserveSlot("a1", "reopened", 5, queuedAt); err != nil || !reserved {
+		t.Errorf("ReserveSlot of reopened room = %v, %v, want true", reserved, err)
+	}
+}
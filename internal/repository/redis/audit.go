@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const AuditLogKey = "audit_log"
+
+// auditLogSize is how many audit entries are kept
+const auditLogSize = 1000
+
+// AuditRepository keeps the most recent admin actions, newest first
+type AuditRepository interface {
+	Append(data string) error
+	List(limit int) ([]string, error)
+}
+
+type auditRepository struct {
+	client *redis.Client
+}
+
+func NewAuditRepository(client *redis.Client) AuditRepository {
+	return &auditRepository{
+		client: client,
+	}
+}
+
+// Append records an entry, dropping the oldest beyond auditLogSize
+func (r *auditRepository) Append(data string) error {
+	ctx := context.Background()
+
+	pipe := r.client.TxPipeline()
+	pipe.LPush(ctx, AuditLogKey, data)
+	pipe.LTrim(ctx, AuditLogKey, 0, auditLogSize-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to append audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// List returns up to limit entries, newest first
+func (r *auditRepository) List(limit int) ([]string, error) {
+	ctx := context.Background()
+
+	entries, err := r.client.LRange(ctx, AuditLogKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const WebhookNonceKey = "webhook_nonce"
+
+// NonceRepository remembers webhook nonces to reject replayed requests
+type NonceRepository interface {
+	Claim(nonce string, ttl time.Duration) (bool, error)
+	Release(nonce string) error
+}
+
+type nonceRepository struct {
+	client *redis.Client
+}
+
+func NewNonceRepository(client *redis.Client) NonceRepository {
+	return &nonceRepository{
+		client: client,
+	}
+}
+
+// Claim records the nonce for ttl. Returns false when it was already used.
+func (r *nonceRepository) Claim(nonce string, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	key := fmt.Sprintf("%s:%s", WebhookNonceKey, nonce)
+
+	claimed, err := r.client.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim webhook nonce: %w", err)
+	}
+
+	return claimed, nil
+}
+
+// Release forgets a claimed nonce so the request can be retried
+func (r *nonceRepository) Release(nonce string) error {
+	ctx := context.Background()
+	key := fmt.Sprintf("%s:%s", WebhookNonceKey, nonce)
+
+	if err := r.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to release webhook nonce: %w", err)
+	}
+
+	return nil
+}
@@ -3,37 +3,351 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"qiscus-agent-allocation/internal/domain/entity"
 
 	"github.com/go-redis/redis/v8"
 )
 
 const (
-	QueueKey = "chat_queue"
+	QueueKey            = "chat_queue:pending"
+	QueueItemsKey       = "chat_queue:items"
+	QueueNotifyKey      = "chat_queue:notify"
+	ProcessingKey       = "chat_queue:in_flight"
+	ProcessingScoresKey = "chat_queue:in_flight:scores"
+	DelayedKey          = "chat_queue:delayed"
+	DelayedScoresKey    = "chat_queue:delayed:scores"
+	DeadLetterKey       = "chat_queue:dead"
+	FlushTokenKey       = "chat_queue:flush_token"
+	ClosedKeyPrefix     = "chat_queue:closed:"
+	// Set of the item IDs of a room, kept with the items hash
+	QueueRoomKeyPrefix = "chat_queue:room:"
 )
 
+// LegacyQueueKey is the list based queue of older versions, drained by the migration
+const LegacyQueueKey = "chat_queue"
+
+// ErrQueueEmpty is returned by Pop and BlockingPop when there is nothing to pop
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// The queue is a sorted set of item IDs (room_id|channel|customer_id) scored
+// by priority then enqueue time, with the item JSON kept in a hash by ID.
+// The hash doubles as the O(1) duplicate index: an ID is in it while the item
+// is queued, delayed or in flight. Every script adding an ID to the hash or
+// removing it updates the room's ID set as well.
+
+// pushScript adds or updates an item and wakes up one blocked consumer
+var pushScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[4], ARGV[1])
+redis.call('LPUSH', KEYS[3], 1)
+redis.call('LTRIM', KEYS[3], 0, 99)
+return 1
+`)
+
+// popScript removes the item with the lowest score and returns its data. The
+// room isn't known before the pop, so its set key is built from the ID and
+// the prefix in ARGV[1].
+var popScript = redis.NewScript(`
+local popped = redis.call('ZPOPMIN', KEYS[1])
+if #popped == 0 then
+	return false
+end
+local data = redis.call('HGET', KEYS[2], popped[1])
+redis.call('HDEL', KEYS[2], popped[1])
+redis.call('SREM', ARGV[1] .. string.match(popped[1], '^[^|]*'), popped[1])
+return data
+`)
+
+// popReliableScript moves the item with the lowest score in flight, recording
+// its visibility deadline and queue score so it can be put back unchanged.
+// The item stays in the items hash while in flight.
+var popReliableScript = redis.NewScript(`
+local popped = redis.call('ZPOPMIN', KEYS[1])
+if #popped == 0 then
+	return false
+end
+redis.call('ZADD', KEYS[3], ARGV[1], popped[1])
+redis.call('HSET', KEYS[4], popped[1], popped[2])
+return redis.call('HGET', KEYS[2], popped[1])
+`)
+
+// ackScript removes an in-flight item. The item data is kept when the item
+// has been requeued or delayed in the meantime.
+var ackScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[3], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[4], ARGV[1])
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) and not redis.call('ZSCORE', KEYS[5], ARGV[1]) then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('SREM', KEYS[6], ARGV[1])
+end
+return 1
+`)
+
+// extendScript pushes the visibility deadline of an item that is still in
+// flight. Returns 0 when it was acked or recovered meanwhile.
+var extendScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// requeueExpiredScript moves in-flight items whose deadline has passed back
+// to the queue with their original score
+var requeueExpiredScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+for _, id in ipairs(ids) do
+	local score = redis.call('HGET', KEYS[4], id)
+	redis.call('ZREM', KEYS[3], id)
+	redis.call('HDEL', KEYS[4], id)
+	if score and redis.call('HEXISTS', KEYS[2], id) == 1 and not redis.call('ZSCORE', KEYS[6], id) then
+		redis.call('ZADD', KEYS[1], score, id)
+		redis.call('LPUSH', KEYS[5], 1)
+	end
+end
+redis.call('LTRIM', KEYS[5], 0, 99)
+return #ids
+`)
+
+// delayScript parks an item until a given time, keeping its queue score so
+// it returns to its place when it is promoted. Returns -1 without parking
+// when the room was closed (KEYS[5]) at or after the item was queued
+// (ARGV[5]), since the marker may expire before the item comes back.
+var delayScript = redis.NewScript(`
+local closedAt = tonumber(redis.call('GET', KEYS[5]) or '0')
+if closedAt > 0 and closedAt >= tonumber(ARGV[5]) then
+	return -1
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[1])
+redis.call('ZADD', KEYS[4], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[6], ARGV[1])
+return 1
+`)
+
+// promoteDelayedScript moves delayed items whose time has come back to the
+// queue with their original score
+var promoteDelayedScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])
+for _, id in ipairs(ids) do
+	local score = redis.call('ZSCORE', KEYS[4], id)
+	redis.call('ZREM', KEYS[3], id)
+	redis.call('ZREM', KEYS[4], id)
+	if score and redis.call('HEXISTS', KEYS[2], id) == 1 then
+		redis.call('ZADD', KEYS[1], score, id)
+		redis.call('LPUSH', KEYS[5], 1)
+	end
+end
+redis.call('LTRIM', KEYS[5], 0, 99)
+return #ids
+`)
+
+// updateScript changes the data and score of an item that is queued, delayed
+// or in flight. Delayed and in-flight items get the score they return with.
+var updateScript = redis.NewScript(`
+local updated = 0
+for _, key in ipairs({KEYS[1], KEYS[3]}) do
+	if redis.call('ZSCORE', key, ARGV[1]) then
+		redis.call('ZADD', key, ARGV[3], ARGV[1])
+		updated = 1
+	end
+end
+if redis.call('HEXISTS', KEYS[4], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[4], ARGV[1], ARGV[3])
+	updated = 1
+end
+if updated == 1 then
+	redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+end
+return updated
+`)
+
+// deadLetterScript removes an item from the queue and the delayed set and
+// appends it to the dead-letter list. The ID is freed so the customer can be
+// queued again.
+var deadLetterScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('SREM', KEYS[6], ARGV[1])
+redis.call('RPUSH', KEYS[5], ARGV[2])
+return 1
+`)
+
+// requeueDeadScript moves a dead-lettered item back to the queue. When the
+// customer was queued again meanwhile only the dead entry is dropped.
+var requeueDeadScript = redis.NewScript(`
+if redis.call('LREM', KEYS[4], 1, ARGV[2]) == 0 then
+	return 0
+end
+if redis.call('HEXISTS', KEYS[2], ARGV[1]) == 1 then
+	return 2
+end
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('SADD', KEYS[5], ARGV[1])
+redis.call('LPUSH', KEYS[3], 1)
+redis.call('LTRIM', KEYS[3], 0, 99)
+return 1
+`)
+
+// removeScript drops an item that is waiting in the queue or delayed. Items
+// in flight are left to the worker.
+var removeScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], ARGV[1]) + redis.call('ZREM', KEYS[3], ARGV[1])
+if removed == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('SREM', KEYS[5], ARGV[1])
+return 1
+`)
+
+// flushScript drops every queued and delayed item if ARGV[1] matches the
+// confirmation token, which can only be used once. Room set keys are built
+// from the IDs and the prefix in ARGV[2]. Returns -1 on mismatch.
+var flushScript = redis.NewScript(`
+if redis.call('GET', KEYS[5]) ~= ARGV[1] then
+	return -1
+end
+redis.call('DEL', KEYS[5])
+local count = 0
+for _, key in ipairs({KEYS[1], KEYS[3]}) do
+	for _, id in ipairs(redis.call('ZRANGE', key, 0, -1)) do
+		redis.call('HDEL', KEYS[2], id)
+		redis.call('SREM', ARGV[2] .. string.match(id, '^[^|]*'), id)
+		count = count + 1
+	end
+end
+redis.call('DEL', KEYS[1], KEYS[3], KEYS[4])
+return count
+`)
+
+// rankScript counts the queued and delayed items ahead of an item, placing
+// delayed items by the score they return with. Returns -1 when the item is
+// neither queued nor delayed.
+var rankScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1]) or redis.call('ZSCORE', KEYS[2], ARGV[1])
+if not score then
+	return -1
+end
+return redis.call('ZCOUNT', KEYS[1], '-inf', '(' .. score) + redis.call('ZCOUNT', KEYS[2], '-inf', '(' .. score)
+`)
+
+// clearClosedScript deletes the closed marker only if it still holds ARGV[1],
+// so a marker set by a later resolution is kept
+var clearClosedScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
 type QueueRepository interface {
-	Push(data string) error
+	Push(data string, score float64) error
 	Pop() (string, error)
+	BlockingPop(ctx context.Context, timeout time.Duration) (string, error)
 	Exists(roomID, channel, customerID string) (bool, error)
+	Get(roomID, channel, customerID string) (string, error)
+	Update(data string, score float64) (bool, error)
+	List() ([]ListedItem, error)
+	Stats() (*entity.QueueStats, error)
+	Rank(roomID, channel, customerID string) (int64, error)
+	RemoveRoom(roomID string) (int, error)
+	SetFlushToken(token string, ttl time.Duration) error
+	Flush(token string) (int, error)
+	MarkClosed(roomID string, at time.Time, ttl time.Duration) error
+	ClosedAt(roomID string) (time.Time, error)
+	ClearClosed(roomID string, at time.Time) error
+
+	// Delayed items are kept out of the queue until a given time
+	Delay(data string, score float64, until time.Time) error
+	PromoteDelayed() (int, error)
+
+	// Dead-letter operations
+	DeadLetter(data string) error
+	ListDead() ([]string, error)
+	RequeueDead(deadData, data string, score float64) (bool, error)
+	RemoveDead(deadData string) (bool, error)
+	PurgeDead() (int, error)
+
+	// Migration from the list based queue
+	PeekLegacy() (string, error)
+	RemoveLegacy(data string) error
+
+	// Reliable queue operations
+	Ack(data string) error
+	Extend(data string) (bool, error)
+	RequeueExpired() (int, error)
+	Release(data string, score float64) error
 }
 
 type queueRepository struct {
-	client *redis.Client
+	client            *redis.Client
+	reliable          bool
+	visibilityTimeout time.Duration
 }
 
-func NewQueueRepository(client *redis.Client) QueueRepository {
+func NewQueueRepository(client *redis.Client, reliable bool, visibilityTimeout time.Duration) QueueRepository {
 	return &queueRepository{
-		client: client,
+		client:            client,
+		reliable:          reliable,
+		visibilityTimeout: visibilityTimeout,
+	}
+}
+
+// QueueItemID returns the ID an item is stored under in the queue
+func QueueItemID(roomID, channel, customerID string) string {
+	return roomID + "|" + channel + "|" + customerID
+}
+
+// itemID reads the ID fields from queue item JSON
+func itemID(data string) (string, error) {
+	id, _, err := itemRef(data)
+	return id, err
+}
+
+// itemRef reads the ID and room ID from queue item JSON
+func itemRef(data string) (id, roomID string, err error) {
+	var item struct {
+		RoomID     string `json:"room_id"`
+		Channel    string `json:"channel"`
+		CustomerID string `json:"customer_id"`
+	}
+
+	if err := json.Unmarshal([]byte(data), &item); err != nil {
+		return "", "", fmt.Errorf("failed to parse queue item: %w", err)
 	}
+
+	return QueueItemID(item.RoomID, item.Channel, item.CustomerID), item.RoomID, nil
 }
 
-func (r *queueRepository) Push(data string) error {
+// Push adds an item to the queue. Lower scores are popped first. Pushing an
+// item that is already queued updates it instead of adding a duplicate.
+func (r *queueRepository) Push(data string, score float64) error {
 	ctx := context.Background()
 
-	// LPUSH adds to the left (beginning) of the list
-	err := r.client.LPush(ctx, QueueKey, data).Err()
+	id, roomID, err := itemRef(data)
 	if err != nil {
+		return err
+	}
+
+	err = pushScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, QueueNotifyKey, QueueRoomKeyPrefix + roomID}, id, data, score).Err()
+	if err != nil && err != redis.Nil {
 		return fmt.Errorf("failed to push to queue: %w", err)
 	}
 
@@ -43,49 +357,530 @@ func (r *queueRepository) Push(data string) error {
 func (r *queueRepository) Pop() (string, error) {
 	ctx := context.Background()
 
-	// RPOP removes and returns element from the right (end) of the list
-	// This gives us FIFO behavior when combined with LPUSH
-	result := r.client.RPop(ctx, QueueKey)
+	var result *redis.Cmd
+	if r.reliable {
+		// Keep the item in flight until it is acked
+		deadline := time.Now().Add(r.visibilityTimeout).UnixMilli()
+		result = popReliableScript.Run(ctx, r.client,
+			[]string{QueueKey, QueueItemsKey, ProcessingKey, ProcessingScoresKey}, deadline)
+	} else {
+		// ZPOPMIN returns the highest priority, oldest item
+		result = popScript.Run(ctx, r.client, []string{QueueKey, QueueItemsKey}, QueueRoomKeyPrefix)
+	}
 
 	// Check if queue is empty
 	if result.Err() == redis.Nil {
-		return "", fmt.Errorf("queue is empty")
+		return "", ErrQueueEmpty
 	}
 
 	if result.Err() != nil {
 		return "", fmt.Errorf("failed to pop from queue: %w", result.Err())
 	}
 
-	return result.Val(), nil
+	data, err := result.Text()
+	if err != nil {
+		return "", fmt.Errorf("failed to read queue item: %w", err)
+	}
+
+	return data, nil
+}
+
+// blockingWaitSlice bounds each BLPOP, go-redis v8 only honours context
+// deadlines on blocking commands, not cancellation
+const blockingWaitSlice = time.Second
+
+// BlockingPop waits up to timeout for an item, returning as soon as one is
+// pushed. Blocking commands can't run inside a script, so it waits on the
+// notify list and then pops with the same script as Pop. A wake-up can be
+// stale (another consumer took the item), in which case it waits again.
+// Nothing is popped once ctx is done.
+func (r *queueRepository) BlockingPop(ctx context.Context, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if ctx.Err() != nil {
+			return "", ErrQueueEmpty
+		}
+
+		data, err := r.Pop()
+		if err != ErrQueueEmpty {
+			return data, err
+		}
+
+		if time.Until(deadline) <= 0 {
+			return "", ErrQueueEmpty
+		}
+
+		// Wait in slices so a cancelled ctx is noticed within a second
+		err = r.client.BLPop(ctx, blockingWaitSlice, QueueNotifyKey).Err()
+		if err != nil && err != redis.Nil {
+			if ctx.Err() != nil {
+				return "", ErrQueueEmpty
+			}
+			return "", fmt.Errorf("failed to wait for queue: %w", err)
+		}
+	}
 }
 
-// Exists checks if room_id already exists in queue
+// Exists checks if an item is queued or being processed
 func (r *queueRepository) Exists(roomID, channel, customerID string) (bool, error) {
 	ctx := context.Background()
 
-	// Get all items in queue without removing them (LRANGE)
-	result := r.client.LRange(ctx, QueueKey, 0, -1)
-	if result.Err() != nil {
-		return false, fmt.Errorf("failed to check queue: %w", result.Err())
+	exists, err := r.client.HExists(ctx, QueueItemsKey, QueueItemID(roomID, channel, customerID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check queue: %w", err)
+	}
+
+	return exists, nil
+}
+
+// Get returns the data of a queued or in-flight item, empty if there is none
+func (r *queueRepository) Get(roomID, channel, customerID string) (string, error) {
+	ctx := context.Background()
+
+	data, err := r.client.HGet(ctx, QueueItemsKey, QueueItemID(roomID, channel, customerID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get queue item: %w", err)
 	}
 
-	items := result.Val()
+	return data, nil
+}
 
-	// Check each item in queue
-	for _, item := range items {
-		var queueItem map[string]interface{}
-		json.Unmarshal([]byte(item), &queueItem)
+// ListedItem is the data of an item returned by List and its
+// entity.QueueState
+type ListedItem struct {
+	Data  string
+	State string
+}
 
-		// Get fields from queue item
-		queueRoomID, _ := queueItem["room_id"].(string)
-		queueChannel, _ := queueItem["channel"].(string)
-		queueCustomerID, _ := queueItem["customer_id"].(string)
+// List returns the in-flight items followed by the queued and delayed items
+// in the order they will be popped, delayed ones by the score they return
+// with. An item caught between two states is listed once, in the later one.
+func (r *queueRepository) List() ([]ListedItem, error) {
+	ctx := context.Background()
 
-		// Check exact match of all 3 fields
-		if queueRoomID == roomID && queueChannel == channel && queueCustomerID == customerID {
-			return true, nil
+	// Read every part at once so each item is seen in a single state
+	pipe := r.client.TxPipeline()
+	queued := pipe.ZRangeWithScores(ctx, QueueKey, 0, -1)
+	delayed := pipe.ZRangeWithScores(ctx, DelayedScoresKey, 0, -1)
+	inFlight := pipe.HGetAll(ctx, ProcessingScoresKey)
+	values := pipe.HGetAll(ctx, QueueItemsKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to list queue: %w", err)
+	}
+
+	type listed struct {
+		id    string
+		state string
+		score float64
+	}
+
+	// An item is delayed or requeued before the worker acks it
+	states := make(map[string]listed)
+	for id, value := range inFlight.Val() {
+		score, _ := strconv.ParseFloat(value, 64)
+		states[id] = listed{id, entity.QueueStateInFlight, score}
+	}
+	for _, z := range delayed.Val() {
+		id, _ := z.Member.(string)
+		states[id] = listed{id, entity.QueueStateDelayed, z.Score}
+	}
+	for _, z := range queued.Val() {
+		id, _ := z.Member.(string)
+		states[id] = listed{id, entity.QueueStateQueued, z.Score}
+	}
+
+	ordered := make([]listed, 0, len(states))
+	for _, item := range states {
+		ordered = append(ordered, item)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if (a.state == entity.QueueStateInFlight) != (b.state == entity.QueueStateInFlight) {
+			return a.state == entity.QueueStateInFlight
+		}
+		if a.score != b.score {
+			return a.score < b.score
+		}
+		return a.id < b.id
+	})
+
+	items := make([]ListedItem, 0, len(ordered))
+	for _, item := range ordered {
+		data, ok := values.Val()[item.id]
+		if !ok {
+			continue
+		}
+		items = append(items, ListedItem{Data: data, State: item.state})
+	}
+
+	return items, nil
+}
+
+// Stats counts queued, delayed, in-flight and dead-lettered items
+func (r *queueRepository) Stats() (*entity.QueueStats, error) {
+	ctx := context.Background()
+
+	pipe := r.client.Pipeline()
+	queued := pipe.ZCard(ctx, QueueKey)
+	delayed := pipe.ZCard(ctx, DelayedKey)
+	inFlight := pipe.ZCard(ctx, ProcessingKey)
+	dead := pipe.LLen(ctx, DeadLetterKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+
+	return &entity.QueueStats{
+		Queued:   queued.Val(),
+		Delayed:  delayed.Val(),
+		InFlight: inFlight.Val(),
+		Dead:     dead.Val(),
+	}, nil
+}
+
+// Rank returns the 0-based position of an item among queued and delayed
+// items, -1 if it is neither (e.g. in flight)
+func (r *queueRepository) Rank(roomID, channel, customerID string) (int64, error) {
+	ctx := context.Background()
+
+	rank, err := rankScript.Run(ctx, r.client, []string{QueueKey, DelayedScoresKey},
+		QueueItemID(roomID, channel, customerID)).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue position: %w", err)
+	}
+
+	return rank, nil
+}
+
+// RemoveRoom drops the room's queued and delayed items and returns how many
+// were removed
+func (r *queueRepository) RemoveRoom(roomID string) (int, error) {
+	ctx := context.Background()
+
+	roomKey := QueueRoomKeyPrefix + roomID
+	ids, err := r.client.SMembers(ctx, roomKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find room in queue: %w", err)
+	}
+
+	removed := 0
+	for _, id := range ids {
+		result, err := removeScript.Run(ctx, r.client,
+			[]string{QueueKey, QueueItemsKey, DelayedKey, DelayedScoresKey, roomKey}, id).Int()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove queue item: %w", err)
 		}
+		removed += result
+	}
+
+	return removed, nil
+}
+
+// MarkClosed records when the room was resolved or assigned outside the
+// queue, kept for ttl
+func (r *queueRepository) MarkClosed(roomID string, at time.Time, ttl time.Duration) error {
+	ctx := context.Background()
+
+	if err := r.client.Set(ctx, ClosedKeyPrefix+roomID, at.UnixMilli(), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to mark room closed: %w", err)
+	}
+
+	return nil
+}
+
+// ClosedAt returns when the room was last closed, zero if not recently
+func (r *queueRepository) ClosedAt(roomID string) (time.Time, error) {
+	ctx := context.Background()
+
+	ms, err := r.client.Get(ctx, ClosedKeyPrefix+roomID).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get room closed marker: %w", err)
+	}
+
+	return time.UnixMilli(ms), nil
+}
+
+// ClearClosed removes the marker set by MarkClosed at at, unless the room was
+// closed again since
+func (r *queueRepository) ClearClosed(roomID string, at time.Time) error {
+	ctx := context.Background()
+
+	err := clearClosedScript.Run(ctx, r.client, []string{ClosedKeyPrefix + roomID},
+		at.UnixMilli()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to clear room closed marker: %w", err)
+	}
+
+	return nil
+}
+
+// SetFlushToken stores the token that confirms a flush for ttl
+func (r *queueRepository) SetFlushToken(token string, ttl time.Duration) error {
+	ctx := context.Background()
+
+	if err := r.client.Set(ctx, FlushTokenKey, token, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store flush token: %w", err)
+	}
+
+	return nil
+}
+
+// Flush drops all queued and delayed items when token matches the stored
+// flush token. Returns the number of items dropped, -1 when the token is wrong
+// or expired.
+func (r *queueRepository) Flush(token string) (int, error) {
+	ctx := context.Background()
+
+	count, err := flushScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, DelayedKey, DelayedScoresKey, FlushTokenKey}, token, QueueRoomKeyPrefix).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to flush queue: %w", err)
+	}
+
+	return count, nil
+}
+
+// Update replaces the data and score of a queued, delayed or in-flight item.
+// Returns false when the item is gone (e.g. it was assigned meanwhile).
+func (r *queueRepository) Update(data string, score float64) (bool, error) {
+	ctx := context.Background()
+
+	id, err := itemID(data)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := updateScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, DelayedScoresKey, ProcessingScoresKey}, id, data, score).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update queue item: %w", err)
+	}
+
+	return updated == 1, nil
+}
+
+// PeekLegacy returns the oldest item left in the legacy list, empty once it
+// is drained
+func (r *queueRepository) PeekLegacy() (string, error) {
+	ctx := context.Background()
+
+	// Items were pushed on the left and popped on the right
+	data, err := r.client.LIndex(ctx, LegacyQueueKey, -1).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read legacy queue: %w", err)
+	}
+
+	return data, nil
+}
+
+// RemoveLegacy drops an item returned by PeekLegacy
+func (r *queueRepository) RemoveLegacy(data string) error {
+	ctx := context.Background()
+
+	if err := r.client.LRem(ctx, LegacyQueueKey, -1, data).Err(); err != nil {
+		return fmt.Errorf("failed to remove legacy queue item: %w", err)
+	}
+
+	return nil
+}
+
+// Ack marks a popped item as done by removing it from the in-flight set
+func (r *queueRepository) Ack(data string) error {
+	if !r.reliable {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	id, roomID, err := itemRef(data)
+	if err != nil {
+		// Malformed items can't be in flight under an ID
+		return nil
+	}
+
+	err = ackScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, ProcessingKey, ProcessingScoresKey, DelayedKey, QueueRoomKeyPrefix + roomID}, id).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to ack queue item: %w", err)
+	}
+
+	return nil
+}
+
+// Extend gives a popped item a full visibility timeout from now. Returns false
+// when the item is no longer in flight, e.g. it was recovered by another worker.
+func (r *queueRepository) Extend(data string) (bool, error) {
+	if !r.reliable {
+		return true, nil
+	}
+
+	ctx := context.Background()
+
+	id, err := itemID(data)
+	if err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(r.visibilityTimeout).UnixMilli()
+	extended, err := extendScript.Run(ctx, r.client, []string{ProcessingKey}, id, deadline).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to extend queue item: %w", err)
+	}
+
+	return extended == 1, nil
+}
+
+// Release gives back a popped item that could not be delayed or
+// dead-lettered. The reliable queue leaves it in flight to be recovered,
+// otherwise it is pushed back with score as it is no longer stored.
+func (r *queueRepository) Release(data string, score float64) error {
+	if r.reliable {
+		return nil
+	}
+
+	return r.Push(data, score)
+}
+
+// RequeueExpired moves in-flight items past their visibility timeout back to the queue
+func (r *queueRepository) RequeueExpired() (int, error) {
+	if !r.reliable {
+		return 0, nil
+	}
+
+	ctx := context.Background()
+
+	count, err := requeueExpiredScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, ProcessingKey, ProcessingScoresKey, QueueNotifyKey, DelayedKey},
+		time.Now().UnixMilli()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue expired items: %w", err)
+	}
+
+	return count, nil
+}
+
+// Delay takes an item out of the queue until the given time. The item still
+// counts as queued for duplicate detection. A popped item must still be acked.
+// Returns ErrRoomClosed if the room was closed after the item was queued.
+func (r *queueRepository) Delay(data string, score float64, until time.Time) error {
+	ctx := context.Background()
+
+	var item entity.QueueItem
+	if err := json.Unmarshal([]byte(data), &item); err != nil {
+		return fmt.Errorf("failed to parse queue item: %w", err)
+	}
+
+	id := QueueItemID(item.RoomID, item.Channel, item.CustomerID)
+	result, err := delayScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, DelayedKey, DelayedScoresKey, ClosedKeyPrefix + item.RoomID, QueueRoomKeyPrefix + item.RoomID},
+		id, data, score, until.UnixMilli(), item.Timestamp.UnixMilli()).Int()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to delay queue item: %w", err)
+	}
+
+	if result == -1 {
+		return ErrRoomClosed
+	}
+
+	return nil
+}
+
+// PromoteDelayed moves delayed items whose time has passed back to the queue
+func (r *queueRepository) PromoteDelayed() (int, error) {
+	ctx := context.Background()
+
+	count, err := promoteDelayedScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, DelayedKey, DelayedScoresKey, QueueNotifyKey},
+		time.Now().UnixMilli()).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to promote delayed items: %w", err)
+	}
+
+	return count, nil
+}
+
+// DeadLetter moves an item out of the queue to the dead-letter list. A popped
+// item must still be acked.
+func (r *queueRepository) DeadLetter(data string) error {
+	ctx := context.Background()
+
+	id, roomID, err := itemRef(data)
+	if err != nil {
+		return err
+	}
+
+	err = deadLetterScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, DelayedKey, DelayedScoresKey, DeadLetterKey, QueueRoomKeyPrefix + roomID}, id, data).Err()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to dead-letter queue item: %w", err)
+	}
+
+	return nil
+}
+
+// ListDead returns dead-lettered items, oldest first
+func (r *queueRepository) ListDead() ([]string, error) {
+	ctx := context.Background()
+
+	items, err := r.client.LRange(ctx, DeadLetterKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead-letter queue: %w", err)
+	}
+
+	return items, nil
+}
+
+// RequeueDead replaces the dead-lettered deadData with data in the queue.
+// Returns false when deadData is no longer dead-lettered.
+func (r *queueRepository) RequeueDead(deadData, data string, score float64) (bool, error) {
+	ctx := context.Background()
+
+	id, roomID, err := itemRef(data)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := requeueDeadScript.Run(ctx, r.client,
+		[]string{QueueKey, QueueItemsKey, QueueNotifyKey, DeadLetterKey, QueueRoomKeyPrefix + roomID}, id, deadData, data, score).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to requeue dead-lettered item: %w", err)
+	}
+
+	return result != 0, nil
+}
+
+// RemoveDead drops one dead-lettered item. Returns false when it was not there.
+func (r *queueRepository) RemoveDead(deadData string) (bool, error) {
+	ctx := context.Background()
+
+	removed, err := r.client.LRem(ctx, DeadLetterKey, 1, deadData).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove dead-lettered item: %w", err)
+	}
+
+	return removed > 0, nil
+}
+
+// PurgeDead drops all dead-lettered items and returns how many there were
+func (r *queueRepository) PurgeDead() (int, error) {
+	ctx := context.Background()
+
+	pipe := r.client.TxPipeline()
+	length := pipe.LLen(ctx, DeadLetterKey)
+	pipe.Del(ctx, DeadLetterKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter queue: %w", err)
 	}
 
-	return false, nil
+	return int(length.Val()), nil
 }
@@ -0,0 +1,366 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestClient returns a client of an in-memory Redis that runs the scripts
+func newTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// testItem returns queue item JSON for the room's customer, queued at
+func testItem(roomID, customerID string, queuedAt time.Time) string {
+	return fmt.Sprintf(`{"customer_id":%q,"room_id":%q,"channel":"wa","timestamp":%q}`,
+		customerID, roomID, queuedAt.UTC().Format(time.RFC3339Nano))
+}
+
+func TestQueuePopOrder(t *testing.T) {
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, false, time.Minute)
+	now := time.Now()
+
+	late, early, middle := testItem("1", "a", now), testItem("2", "b", now), testItem("3", "c", now)
+	for _, push := range []struct {
+		data  string
+		score float64
+	}{{late, 30}, {early, 10}, {middle, 20}, {late, 30}} {
+		if err := queue.Push(push.data, push.score); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+
+	for _, want := range []string{early, middle, late} {
+		got, err := queue.Pop()
+		if err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+		if got != want {
+			t.Errorf("Pop = %s, want %s", got, want)
+		}
+	}
+
+	// Pushing the same item twice doesn't queue it twice
+	if _, err := queue.Pop(); err != ErrQueueEmpty {
+		t.Errorf("Pop on empty queue: err %v, want %v", err, ErrQueueEmpty)
+	}
+}
+
+func TestQueueUpdate(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, true, time.Minute)
+	now := time.Now()
+
+	inFlight, delayed, queued := testItem("1", "a", now), testItem("2", "b", now), testItem("3", "c", now)
+	for i, data := range []string{inFlight, delayed, queued} {
+		if err := queue.Push(data, float64(10*(i+1))); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+
+	// Pop the first two, then park the second
+	for range 2 {
+		if _, err := queue.Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+	}
+	if err := queue.Delay(delayed, 20, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Delay: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		scoreKey string
+		score    func(id string) (float64, error)
+	}{
+		{"in flight", inFlight, ProcessingScoresKey, func(id string) (float64, error) {
+			return client.HGet(ctx, ProcessingScoresKey, id).Float64()
+		}},
+		{"delayed", delayed, DelayedScoresKey, func(id string) (float64, error) {
+			return client.ZScore(ctx, DelayedScoresKey, id).Result()
+		}},
+		{"queued", queued, QueueKey, func(id string) (float64, error) {
+			return client.ZScore(ctx, QueueKey, id).Result()
+		}},
+	}
+
+	for _, tt := range tests {
+		bumped := tt.data[:len(tt.data)-1] + `,"priority":5}`
+		updated, err := queue.Update(bumped, -5)
+		if err != nil || !updated {
+			t.Errorf("%s: Update = %v, %v, want true", tt.name, updated, err)
+			continue
+		}
+
+		id, _ := itemID(tt.data)
+		if score, err := tt.score(id); err != nil || score != -5 {
+			t.Errorf("%s: score in %s = %v, %v, want -5", tt.name, tt.scoreKey, score, err)
+		}
+
+		if data := client.HGet(ctx, QueueItemsKey, id).Val(); data != bumped {
+			t.Errorf("%s: stored %s, want %s", tt.name, data, bumped)
+		}
+	}
+
+	// The update doesn't move a delayed item back to the queue
+	if count := client.ZCard(ctx, QueueKey).Val(); count != 1 {
+		t.Errorf("%d items queued, want 1", count)
+	}
+
+	// Nor queue an item that is gone
+	gone := testItem("4", "d", now)
+	if updated, err := queue.Update(gone, 1); err != nil || updated {
+		t.Errorf("Update of missing item = %v, %v, want false", updated, err)
+	}
+	if exists, _ := queue.Exists("4", "wa", "d"); exists {
+		t.Error("Update stored a missing item")
+	}
+}
+
+func TestQueueAckAfterDelay(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, true, time.Minute)
+	data := testItem("1", "a", time.Now())
+
+	if err := queue.Push(data, 10); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if _, err := queue.Pop(); err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+
+	// The worker delays a popped item, then acks the in-flight copy
+	if err := queue.Delay(data, 10, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Delay: %v", err)
+	}
+	if err := queue.Ack(data); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	if exists, _ := queue.Exists("1", "wa", "a"); !exists {
+		t.Fatal("ack dropped the delayed item")
+	}
+	if count := client.ZCard(ctx, ProcessingKey).Val(); count != 0 {
+		t.Errorf("%d items in flight, want 0", count)
+	}
+
+	promoted, err := queue.PromoteDelayed()
+	if err != nil || promoted != 1 {
+		t.Fatalf("PromoteDelayed = %d, %v, want 1", promoted, err)
+	}
+
+	if score, err := client.ZScore(ctx, QueueKey, "1|wa|a").Result(); err != nil || score != 10 {
+		t.Errorf("promoted score = %v, %v, want the original 10", score, err)
+	}
+	if got, err := queue.Pop(); err != nil || got != data {
+		t.Errorf("Pop after promotion = %s, %v, want %s", got, err, data)
+	}
+}
+
+func TestQueueRecoverySkipsDelayed(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	// Items are past their visibility timeout as soon as they are popped
+	queue := NewQueueRepository(client, true, -time.Minute)
+	now := time.Now()
+
+	crashed, delayed := testItem("1", "a", now), testItem("2", "b", now)
+	for i, data := range []string{crashed, delayed} {
+		if err := queue.Push(data, float64(10*(i+1))); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		if _, err := queue.Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+	}
+
+	// The worker delayed the second item but died before acking it
+	if err := queue.Delay(delayed, 20, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Delay: %v", err)
+	}
+
+	if _, err := queue.RequeueExpired(); err != nil {
+		t.Fatalf("RequeueExpired: %v", err)
+	}
+
+	queued := client.ZRangeWithScores(ctx, QueueKey, 0, -1).Val()
+	if len(queued) != 1 || queued[0].Member != "1|wa|a" || queued[0].Score != 10 {
+		t.Errorf("queued after recovery = %v, want only 1|wa|a with score 10", queued)
+	}
+	if _, err := client.ZScore(ctx, DelayedKey, "2|wa|b").Result(); err != nil {
+		t.Errorf("delayed item left the delayed set: %v", err)
+	}
+	if count := client.ZCard(ctx, ProcessingKey).Val(); count != 0 {
+		t.Errorf("%d items in flight, want 0", count)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, true, time.Minute)
+	data := testItem("1", "a", time.Now())
+
+	if err := queue.Push(data, 10); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if _, err := queue.Pop(); err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+
+	dead := data[:len(data)-1] + `,"attempts":3}`
+	if err := queue.DeadLetter(dead); err != nil {
+		t.Fatalf("DeadLetter: %v", err)
+	}
+	if err := queue.Ack(data); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	// The customer can be queued again while dead-lettered
+	if exists, _ := queue.Exists("1", "wa", "a"); exists {
+		t.Error("dead-lettered item still counts as queued")
+	}
+	if items, _ := queue.ListDead(); len(items) != 1 || items[0] != dead {
+		t.Errorf("ListDead = %v, want [%s]", items, dead)
+	}
+
+	requeued, err := queue.RequeueDead(dead, data, 10)
+	if err != nil || !requeued {
+		t.Fatalf("RequeueDead = %v, %v, want true", requeued, err)
+	}
+	if got, err := queue.Pop(); err != nil || got != data {
+		t.Errorf("Pop after requeue = %s, %v, want %s", got, err, data)
+	}
+	if items, _ := queue.ListDead(); len(items) != 0 {
+		t.Errorf("ListDead after requeue = %v, want none", items)
+	}
+}
+
+func TestQueueClearClosed(t *testing.T) {
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, false, time.Minute)
+	first := time.Now().Add(-time.Second)
+	second := time.Now()
+
+	for _, at := range []time.Time{first, second} {
+		if err := queue.MarkClosed("1", at, time.Hour); err != nil {
+			t.Fatalf("MarkClosed: %v", err)
+		}
+	}
+
+	// Undoing the first closing keeps the marker of the second
+	if err := queue.ClearClosed("1", first); err != nil {
+		t.Fatalf("ClearClosed: %v", err)
+	}
+	if closedAt, err := queue.ClosedAt("1"); err != nil || closedAt.UnixMilli() != second.UnixMilli() {
+		t.Errorf("ClosedAt = %v, %v, want %v", closedAt, err, second)
+	}
+
+	if err := queue.ClearClosed("1", second); err != nil {
+		t.Fatalf("ClearClosed: %v", err)
+	}
+	if closedAt, err := queue.ClosedAt("1"); err != nil || !closedAt.IsZero() {
+		t.Errorf("ClosedAt after clearing = %v, %v, want zero", closedAt, err)
+	}
+}
+
+func TestQueueDelayClosedRoom(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, false, time.Minute)
+	queuedAt := time.Now().Add(-time.Minute)
+
+	resolved, reopened := testItem("1", "a", queuedAt), testItem("2", "b", queuedAt)
+	for _, data := range []string{resolved, reopened} {
+		if err := queue.Push(data, 10); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	if err := queue.MarkClosed("1", queuedAt, time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+	if err := queue.MarkClosed("2", queuedAt.Add(-time.Hour), time.Hour); err != nil {
+		t.Fatalf("MarkClosed: %v", err)
+	}
+
+	// A room closed once the customer was queued isn't parked again
+	until := time.Now().Add(time.Hour)
+	if err := queue.Delay(resolved, 10, until); err != ErrRoomClosed {
+		t.Errorf("Delay of closed room: err %v, want %v", err, ErrRoomClosed)
+	}
+	if _, err := client.ZScore(ctx, DelayedKey, "1|wa|a").Result(); err != redis.Nil {
+		t.Errorf("closed room was delayed: %v", err)
+	}
+
+	// An older marker belongs to a conversation before this one
+	if err := queue.Delay(reopened, 10, until); err != nil {
+		t.Errorf("Delay of reopened room: %v", err)
+	}
+	if _, err := client.ZScore(ctx, DelayedKey, "2|wa|b").Result(); err != nil {
+		t.Errorf("reopened room wasn't delayed: %v", err)
+	}
+}
+
+func TestQueueRemoveRoom(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	queue := NewQueueRepository(client, true, time.Minute)
+	now := time.Now()
+
+	inFlight, delayed, queued := testItem("1", "a", now), testItem("1", "b", now), testItem("1", "c", now)
+	other := testItem("2", "d", now)
+	for i, data := range []string{inFlight, delayed, queued, other} {
+		if err := queue.Push(data, float64(10*(i+1))); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	for range 2 {
+		if _, err := queue.Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+	}
+	if err := queue.Delay(delayed, 20, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Delay: %v", err)
+	}
+
+	removed, err := queue.RemoveRoom("1")
+	if err != nil || removed != 2 {
+		t.Fatalf("RemoveRoom = %d, %v, want 2", removed, err)
+	}
+
+	for _, customerID := range []string{"b", "c"} {
+		if exists, _ := queue.Exists("1", "wa", customerID); exists {
+			t.Errorf("customer %s still queued", customerID)
+		}
+	}
+	if exists, _ := queue.Exists("2", "wa", "d"); !exists {
+		t.Error("other room was removed")
+	}
+
+	// The workers still own the popped items and ack them
+	if count := client.ZCard(ctx, ProcessingKey).Val(); count != 2 {
+		t.Errorf("%d items in flight, want 2", count)
+	}
+	for _, data := range []string{inFlight, delayed} {
+		if err := queue.Ack(data); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+	if members := client.SMembers(ctx, QueueRoomKeyPrefix+"1").Val(); len(members) != 0 {
+		t.Errorf("room index still holds %v", members)
+	}
+}
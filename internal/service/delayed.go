@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"qiscus-agent-allocation/internal/usecase"
+)
+
+// DelayedQueueService moves delayed queue items (e.g. parked outside business
+// hours) back to the queue once they are due
+type DelayedQueueService struct {
+	allocationUsecase usecase.AllocationUsecase
+	interval          time.Duration
+}
+
+func NewDelayedQueueService(allocationUsecase usecase.AllocationUsecase, interval time.Duration) *DelayedQueueService {
+	return &DelayedQueueService{
+		allocationUsecase: allocationUsecase,
+		interval:          interval,
+	}
+}
+
+func (s *DelayedQueueService) Start(ctx context.Context) {
+	log.Println("Delayed queue service started")
+
+	// Promote items that became due while the service was down
+	s.promote()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Delayed queue service stopped")
+			return
+		case <-ticker.C:
+			s.promote()
+		}
+	}
+}
+
+func (s *DelayedQueueService) promote() {
+	if _, err := s.allocationUsecase.PromoteDelayedItems(); err != nil {
+		log.Printf("Failed to promote delayed items: %v", err)
+	}
+}
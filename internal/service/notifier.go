@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qiscus-agent-allocation/internal/domain/entity"
+	"qiscus-agent-allocation/internal/usecase"
+)
+
+// DefaultPositionTemplate is used for channels without a template of their own
+const DefaultPositionTemplate = "You are number {position} in the queue. Estimated waiting time: {wait}."
+
+// notifyConcurrency bounds the position messages sent at once by the periodic update
+const notifyConcurrency = 5
+
+// NotifierService tells waiting customers their queue position and estimated
+// waiting time, right after they are queued and then every interval. Customers
+// of a segment outside business hours are left alone.
+type NotifierService struct {
+	allocationUsecase usecase.AllocationUsecase
+	interval          time.Duration
+	defaultWait       time.Duration
+	templates         map[string]string
+	businessHours     *usecase.BusinessHours
+	enqueued          chan entity.QueueItem
+}
+
+type NotifierConfig struct {
+	// Interval between updates, 0 to only notify on enqueue
+	Interval time.Duration
+	// DefaultWait per position, used until there are recent assignments
+	DefaultWait time.Duration
+	// Templates by channel ("*" for all others) with {position} and {wait} placeholders
+	Templates map[string]string
+	// BusinessHours of the segments, nil when always open
+	BusinessHours *usecase.BusinessHours
+}
+
+func NewNotifierService(allocationUsecase usecase.AllocationUsecase, config NotifierConfig) *NotifierService {
+	templates := make(map[string]string, len(config.Templates))
+	for channel, template := range config.Templates {
+		templates[strings.ToLower(channel)] = template
+	}
+
+	return &NotifierService{
+		allocationUsecase: allocationUsecase,
+		interval:          config.Interval,
+		defaultWait:       config.DefaultWait,
+		templates:         templates,
+		businessHours:     config.BusinessHours,
+		enqueued:          make(chan entity.QueueItem, 100),
+	}
+}
+
+// Enqueued schedules the first position message for a newly queued customer.
+// It never blocks the caller; the message is dropped when the backlog is full.
+func (s *NotifierService) Enqueued(item entity.QueueItem) {
+	select {
+	case s.enqueued <- item:
+	default:
+		log.Printf("Notifier backlog full, skipping position message for room %s", item.RoomID)
+	}
+}
+
+func (s *NotifierService) Start(ctx context.Context) {
+	log.Println("Notifier service started")
+
+	// Without an interval only enqueues are notified
+	var wg sync.WaitGroup
+	if s.interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runPeriodic(ctx)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			log.Println("Notifier service stopped")
+			return
+		case item := <-s.enqueued:
+			s.notify(item)
+		}
+	}
+}
+
+// runPeriodic updates every waiting customer each interval. It runs apart
+// from the enqueue loop so a long queue or a slow Qiscus doesn't hold up the
+// first message of new customers. An update stops sending once the interval
+// is over, and ticks missed meanwhile are skipped.
+func (s *NotifierService) runPeriodic(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tickCtx, cancel := context.WithTimeout(ctx, s.interval)
+			s.notifyAll(tickCtx)
+			cancel()
+		}
+	}
+}
+
+// notify sends the position message to one customer if they are still waiting
+func (s *NotifierService) notify(item entity.QueueItem) {
+	if s.isClosed(item.Channel) {
+		return
+	}
+
+	position, err := s.allocationUsecase.GetQueuePosition(item.RoomID, item.Channel, item.CustomerID)
+	if err != nil {
+		log.Printf("Failed to get queue position of room %s: %v", item.RoomID, err)
+		return
+	}
+
+	// Already picked up by a worker
+	if position == 0 {
+		return
+	}
+
+	s.send(item, position, s.waitPerPosition())
+}
+
+// notifyAll sends the position message to every queued or delayed customer,
+// a few at a time, until ctx is done
+func (s *NotifierService) notifyAll(ctx context.Context) {
+	entries, err := s.allocationUsecase.ListQueueEntries()
+	if err != nil {
+		log.Printf("Failed to list queue: %v", err)
+		return
+	}
+
+	// Customers being assigned have no position
+	waiting := make([]entity.QueueEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.State != entity.QueueStateInFlight && !s.isClosed(entry.Channel) {
+			waiting = append(waiting, entry)
+		}
+	}
+
+	if len(waiting) == 0 {
+		return
+	}
+
+	waitPerPosition := s.waitPerPosition()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	slots := make(chan struct{}, notifyConcurrency)
+	for i, entry := range waiting {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			log.Printf("Queue position update ran out of time, skipped %d of %d customers", len(waiting)-i, len(waiting))
+			return
+		}
+
+		wg.Add(1)
+		go func(entry entity.QueueEntry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.send(entry.QueueItem, entry.Position, waitPerPosition)
+		}(entry)
+	}
+}
+
+// isClosed reports whether the segment serving channel is outside business
+// hours, where the estimate would be misleading
+func (s *NotifierService) isClosed(channel string) bool {
+	closed, _, _ := s.businessHours.Check(channel, time.Now())
+	return closed
+}
+
+func (s *NotifierService) send(item entity.QueueItem, position int, waitPerPosition time.Duration) {
+	message := s.render(item.Channel, position, time.Duration(position)*waitPerPosition)
+
+	if err := s.allocationUsecase.SendMessage(item.RoomID, message); err != nil {
+		log.Printf("Failed to send queue position to room %s: %v", item.RoomID, err)
+	}
+}
+
+// waitPerPosition estimates the wait per queue position from recent
+// assignments, falling back to the configured default
+func (s *NotifierService) waitPerPosition() time.Duration {
+	wait, err := s.allocationUsecase.GetWaitPerPosition()
+	if err != nil {
+		log.Printf("Failed to estimate waiting time: %v", err)
+	}
+
+	if wait <= 0 {
+		return s.defaultWait
+	}
+
+	return wait
+}
+
+func (s *NotifierService) render(channel string, position int, wait time.Duration) string {
+	template, ok := s.templates[strings.ToLower(channel)]
+	if !ok {
+		template, ok = s.templates[usecase.DefaultDivisionRoute]
+	}
+	if !ok {
+		template = DefaultPositionTemplate
+	}
+
+	return strings.NewReplacer(
+		"{position}", strconv.Itoa(position),
+		"{wait}", formatWait(wait),
+	).Replace(template)
+}
+
+// formatWait rounds the wait up to whole minutes, e.g. "3 minutes"
+func formatWait(wait time.Duration) string {
+	minutes := int(math.Ceil(wait.Minutes()))
+	if minutes <= 1 {
+		return "1 minute"
+	}
+
+	return fmt.Sprintf("%d minutes", minutes)
+}
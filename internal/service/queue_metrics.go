@@ -0,0 +1,41 @@
+package service
+
+import (
+	"log"
+
+	"qiscus-agent-allocation/internal/usecase"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queueLengthDesc = prometheus.NewDesc("queue_length",
+	"Items in the queue by state (queued, delayed, in_flight, dead).", []string{"state"}, nil)
+
+// QueueCollector reads the queue length from Redis on every scrape, so it is
+// the same whichever instance is scraped
+type QueueCollector struct {
+	allocationUsecase usecase.AllocationUsecase
+}
+
+func NewQueueCollector(allocationUsecase usecase.AllocationUsecase) *QueueCollector {
+	return &QueueCollector{
+		allocationUsecase: allocationUsecase,
+	}
+}
+
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+}
+
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.allocationUsecase.GetQueueStats()
+	if err != nil {
+		log.Printf("Failed to collect queue metrics: %v", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(stats.Queued), "queued")
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(stats.Delayed), "delayed")
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(stats.InFlight), "in_flight")
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(stats.Dead), "dead")
+}
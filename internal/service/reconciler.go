@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"qiscus-agent-allocation/internal/domain/entity"
+	"qiscus-agent-allocation/internal/usecase"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reconcileRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reconcile_runs_total",
+		Help: "Capacity reconciliation runs.",
+	})
+	reconcileCorrections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reconcile_corrections_total",
+		Help: "Agent capacity corrections made by reconciliation, by agent.",
+	}, []string{"agent_id"})
+)
+
+// ReconcilerService corrects agent capacity in Redis against the active
+// conversations in Qiscus, fixing drift from missed resolved webhooks or
+// chats reassigned from the Qiscus dashboard
+type ReconcilerService struct {
+	allocationUsecase usecase.AllocationUsecase
+	interval          time.Duration
+	mu                sync.Mutex
+}
+
+func NewReconcilerService(allocationUsecase usecase.AllocationUsecase, interval time.Duration) *ReconcilerService {
+	return &ReconcilerService{
+		allocationUsecase: allocationUsecase,
+		interval:          interval,
+	}
+}
+
+func (s *ReconcilerService) Start(ctx context.Context) {
+	log.Println("Reconciler service started")
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Reconciler service stopped")
+			return
+		case <-ticker.C:
+			if _, err := s.Reconcile(); err != nil {
+				log.Printf("Failed to reconcile agent capacity: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile runs one reconciliation pass over all agents and returns the corrections made
+func (s *ReconcilerService) Reconcile() ([]entity.CapacityCorrection, error) {
+	// Periodic and manual runs must not overlap
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reconcileRuns.Inc()
+
+	agents, err := s.allocationUsecase.GetAllAgents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agents: %w", err)
+	}
+
+	corrections := []entity.CapacityCorrection{}
+	for _, agent := range agents {
+		correction, err := s.allocationUsecase.ReconcileAgentRooms(agent.ID)
+		if err != nil {
+			log.Printf("Failed to reconcile agent %s: %v", agent.ID, err)
+			continue
+		}
+
+		if correction == nil {
+			continue
+		}
+
+		log.Printf("Corrected capacity for agent %s: %d -> %d (added rooms %v, removed rooms %v)",
+			correction.AgentID, correction.Before, correction.After,
+			correction.AddedRooms, correction.RemovedRooms)
+
+		reconcileCorrections.WithLabelValues(correction.AgentID).Inc()
+		corrections = append(corrections, *correction)
+	}
+
+	log.Printf("Reconciled %d agents, %d corrections", len(agents), len(corrections))
+	return corrections, nil
+}
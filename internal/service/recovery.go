@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"qiscus-agent-allocation/internal/usecase"
+)
+
+// RecoveryService returns in-flight queue items whose visibility timeout
+// expired (e.g. the worker crashed mid-assignment) back to the queue
+type RecoveryService struct {
+	allocationUsecase usecase.AllocationUsecase
+	interval          time.Duration
+}
+
+func NewRecoveryService(allocationUsecase usecase.AllocationUsecase, interval time.Duration) *RecoveryService {
+	return &RecoveryService{
+		allocationUsecase: allocationUsecase,
+		interval:          interval,
+	}
+}
+
+func (s *RecoveryService) Start(ctx context.Context) {
+	log.Println("Recovery service started")
+
+	// Recover items left over from a previous run before waiting for the first tick
+	s.recover()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Recovery service stopped")
+			return
+		case <-ticker.C:
+			s.recover()
+		}
+	}
+}
+
+func (s *RecoveryService) recover() {
+	if _, err := s.allocationUsecase.RequeueExpiredItems(); err != nil {
+		log.Printf("Failed to recover in-flight items: %v", err)
+	}
+}
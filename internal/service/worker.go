@@ -3,121 +3,671 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"qiscus-agent-allocation/internal/domain/entity"
 	"qiscus-agent-allocation/internal/usecase"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of one worker iteration
+const (
+	outcomeAssigned        = "assigned"
+	outcomeEmpty           = "empty"
+	outcomeQueueError      = "queue_error"
+	outcomeMalformed       = "malformed"
+	outcomeClosed          = "closed"
+	outcomeAfterHours      = "after_hours"
+	outcomePaused          = "paused"
+	outcomeAgentsError     = "agents_error"
+	outcomeNoAgents        = "no_agents"
+	outcomeNoSkilledAgents = "no_skilled_agents"
+	outcomeAtCapacity      = "at_capacity"
+	outcomeExpired         = "expired"
+	outcomeAssignFailed    = "assign_failed"
+)
+
+var (
+	workerIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_iterations_total",
+		Help: "Worker loop iterations by outcome.",
+	}, []string{"outcome"})
+	assignedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_assigned_total",
+		Help: "Customers assigned to an agent by the worker, by channel.",
+	}, []string{"channel"})
+	assignmentLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "assignment_latency_seconds",
+		Help:    "Time from entering the queue to being assigned to an agent, by channel.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+	}, []string{"channel"})
 )
 
 type WorkerService struct {
 	allocationUsecase usecase.AllocationUsecase
+	workers           int
+	popTimeout        time.Duration
+	skillFallbackWait time.Duration
+	strategy          usecase.AllocationStrategy
+	stickyTTL         time.Duration
+	businessHours     *usecase.BusinessHours
+	maxAttempts       int
+	retryBaseDelay    time.Duration
+	retryMaxDelay     time.Duration
+
+	pausesMu sync.Mutex
+	pauses   map[string]segmentPause
 }
 
-func NewWorkerService(allocationUsecase usecase.AllocationUsecase) *WorkerService {
+// segmentPause holds back a channel after no agent could take one of its
+// customers. The failures count grows the next pause while it keeps failing.
+type segmentPause struct {
+	until    time.Time
+	failures int
+}
+
+type WorkerConfig struct {
+	Workers           int
+	PopTimeout        time.Duration
+	SkillFallbackWait time.Duration
+	Strategy          usecase.AllocationStrategy
+	StickyTTL         time.Duration
+	BusinessHours     *usecase.BusinessHours
+	// MaxAttempts failed assignments move an item to the dead-letter queue, 0 never does
+	MaxAttempts int
+	// Failed items are retried after RetryBaseDelay, doubling up to RetryMaxDelay.
+	// A channel without a free agent is paused by the same backoff.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+func NewWorkerService(allocationUsecase usecase.AllocationUsecase, config WorkerConfig) *WorkerService {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+
+	if config.PopTimeout == 0 {
+		config.PopTimeout = 5 * time.Second
+	}
+
+	if config.RetryBaseDelay <= 0 {
+		config.RetryBaseDelay = time.Second
+	}
+
+	if config.RetryMaxDelay < config.RetryBaseDelay {
+		config.RetryMaxDelay = config.RetryBaseDelay
+	}
+
 	return &WorkerService{
 		allocationUsecase: allocationUsecase,
+		workers:           config.Workers,
+		popTimeout:        config.PopTimeout,
+		skillFallbackWait: config.SkillFallbackWait,
+		strategy:          config.Strategy,
+		stickyTTL:         config.StickyTTL,
+		businessHours:     config.BusinessHours,
+		maxAttempts:       config.MaxAttempts,
+		retryBaseDelay:    config.RetryBaseDelay,
+		retryMaxDelay:     config.RetryMaxDelay,
+		pauses:            make(map[string]segmentPause),
 	}
 }
 
+// Start runs the worker pool and blocks until ctx is cancelled and every
+// worker has finished its current item
 func (w *WorkerService) Start(ctx context.Context) {
-	log.Println("Worker service started")
+	log.Printf("Worker service started with %d workers, %s strategy", w.workers, w.strategy.Name())
+
+	var wg sync.WaitGroup
+	for i := 1; i <= w.workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			w.run(ctx, id)
+		}(i)
+	}
+
+	wg.Wait()
+	log.Println("Worker service stopped")
+}
+
+func (w *WorkerService) run(ctx context.Context, id int) {
+	logger := log.New(log.Writer(), fmt.Sprintf("[worker %d] ", id), log.Flags()|log.Lmsgprefix)
+	logger.Println("Worker started")
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Worker service stopped")
+			logger.Println("Worker stopped")
 			return
 		default:
-			w.processQueue()
+			outcome := w.processQueue(ctx, logger)
+			workerIterations.WithLabelValues(outcome).Inc()
 		}
 	}
 }
 
-func (w *WorkerService) processQueue() {
-	// 1. Check Redis Queue (RPOP)
-	queueData, err := w.allocationUsecase.GetFromQueue()
-	if err != nil || queueData == "" {
-		// Queue empty, wait and try again
-		time.Sleep(5 * time.Second)
-		return
+// processQueue handles one queue item. Once an item is popped it is processed
+// to completion even if ctx is cancelled. When no agent can take the item its
+// channel is paused and its customers are held in their places until it
+// resumes; items that fail on their own are retried later with backoff. Either
+// way the worker moves on to the next customer. Returns the outcome for metrics.
+func (w *WorkerService) processQueue(ctx context.Context, logger *log.Logger) string {
+	// 1. Wait for the next item in Redis Queue
+	queueData, err := w.allocationUsecase.GetFromQueue(ctx, w.popTimeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Printf("Failed to get from queue: %v", err)
+		}
+		// Redis unavailable, back off before trying again
+		sleep(ctx, 5*time.Second)
+		return outcomeQueueError
 	}
 
-	log.Printf("Processing queue item: %s", queueData)
+	if queueData == "" {
+		// Queue stayed empty for popTimeout, wait again
+		return outcomeEmpty
+	}
+
+	logger.Printf("Processing queue item: %s", queueData)
 
 	// 2. Extract customer request
 	var item entity.QueueItem
 	if err := json.Unmarshal([]byte(queueData), &item); err != nil {
-		log.Printf("Failed to parse queue item: %v", err)
-		return
+		logger.Printf("Failed to parse queue item: %v", err)
+		// Drop malformed item so it is not recovered again
+		w.ackQueueItem(logger, queueData)
+		return outcomeMalformed
+	}
+
+	// 3. Skip rooms resolved or manually assigned while waiting
+	if w.skipClosed(logger, item, queueData) {
+		return outcomeClosed
+	}
+
+	// 4. Park the item until its segment opens when outside business hours
+	if closed, opensAt, message := w.businessHours.Check(item.Channel, time.Now()); closed {
+		w.delayUntilOpen(logger, item, queueData, opensAt, message)
+		return outcomeAfterHours
 	}
 
-	// 3. Fetch online agents from Qiscus API
-	agents, err := w.allocationUsecase.GetOnlineAgents()
+	// 5. Hold the item with the rest of its channel while the channel is paused
+	if until, paused := w.pausedUntil(item.Channel); paused {
+		w.holdForSegment(logger, item, queueData, until)
+		return outcomePaused
+	}
+
+	// 6. Fetch online agents of the channel's divisions from Qiscus API
+	agents, err := w.allocationUsecase.GetOnlineAgentsForChannel(item.Channel)
 	if err != nil {
-		log.Printf("Failed to get online agents: %v", err)
-		// Return to queue
-		w.allocationUsecase.AddToQueue(item)
-		time.Sleep(5 * time.Second)
-		return
+		logger.Printf("Failed to get online agents: %v", err)
+		w.holdForSegment(logger, item, queueData, w.pauseSegment(logger, item.Channel))
+		return outcomeAgentsError
 	}
 
 	if len(agents) == 0 {
-		log.Println("No online agents available")
-		// Return to queue
-		w.allocationUsecase.AddToQueue(item)
-		time.Sleep(5 * time.Second)
-		return
+		logger.Println("No online agents available")
+		w.holdForSegment(logger, item, queueData, w.pauseSegment(logger, item.Channel))
+		return outcomeNoAgents
 	}
 
-	// 4. Check agent capacity and filter available agents
-	availableAgent := w.findAvailableAgent(agents)
+	// 7. Keep agents whose skills match the channel
+	agents = w.filterBySkill(logger, agents, item)
+	if len(agents) == 0 {
+		logger.Printf("No online agents for channel %s", item.Channel)
+		w.retryLater(logger, item, queueData, "no online agents for channel")
+		return outcomeNoSkilledAgents
+	}
+
+	// 8. Prefer the agent Qiscus suggested, then the customer's previous agent,
+	// otherwise let the allocation strategy pick an agent with free capacity
+	// and reserve a slot
+	availableAgent := w.reserveCandidateAgent(logger, agents, item)
 	if availableAgent == nil {
-		log.Println("No available agents (all at capacity)")
-		// Return to queue
-		w.allocationUsecase.AddToQueue(item)
-		time.Sleep(5 * time.Second)
-		return
+		availableAgent = w.reservePreviousAgent(logger, agents, item)
+	}
+	if availableAgent == nil {
+		availableAgent = w.findAvailableAgent(logger, agents, item)
+	}
+	if availableAgent == nil {
+		// Reserving fails for every agent once the room is closed
+		if w.skipClosed(logger, item, queueData) {
+			return outcomeClosed
+		}
+
+		logger.Println("No available agents (all at capacity)")
+		w.holdForSegment(logger, item, queueData, w.pauseSegment(logger, item.Channel))
+		return outcomeAtCapacity
 	}
 
-	// 5. Assign agent via Qiscus API
+	// 9. Renew the visibility timeout so the item isn't recovered and assigned
+	// again while the Qiscus calls above and below run long
+	extended, err := w.allocationUsecase.ExtendQueueItem(queueData)
+	if err != nil || !extended {
+		if err != nil {
+			logger.Printf("Failed to extend queue item: %v", err)
+		} else {
+			logger.Printf("Room %s was recovered by another worker meanwhile, skipping", item.RoomID)
+		}
+		// Give back the reserved slot, the item is handled by whoever holds it now
+		if _, err := w.allocationUsecase.ReleaseAgentSlot(availableAgent.ID, item.RoomID); err != nil {
+			logger.Printf("Failed to release agent slot: %v", err)
+		}
+		return outcomeExpired
+	}
+
+	// A supervisor may have taken the room over since the slot was reserved;
+	// releasing leaves the room with the supervisor's agent
+	if w.skipClosed(logger, item, queueData) {
+		if _, err := w.allocationUsecase.ReleaseAgentSlot(availableAgent.ID, item.RoomID); err != nil {
+			logger.Printf("Failed to release agent slot: %v", err)
+		}
+		return outcomeClosed
+	}
+
+	// 10. Assign agent via Qiscus API
 	err = w.allocationUsecase.AssignAgent(item.RoomID, availableAgent.ID)
 	if err != nil {
-		log.Printf("Failed to assign agent: %v", err)
-		// Return to queue
-		w.allocationUsecase.AddToQueue(item)
-		time.Sleep(5 * time.Second)
+		logger.Printf("Failed to assign agent: %v", err)
+		// Give back the reserved slot
+		if _, err := w.allocationUsecase.ReleaseAgentSlot(availableAgent.ID, item.RoomID); err != nil {
+			logger.Printf("Failed to release agent slot: %v", err)
+		}
+		w.failAssignment(logger, item, queueData, err)
+		return outcomeAssignFailed
+	}
+
+	// 11. Remove item from in-flight list
+	w.ackQueueItem(logger, queueData)
+	w.resumeSegment(item.Channel)
+
+	// 12. Remember the agent for the customer's next chat
+	if w.stickyTTL > 0 {
+		if err := w.allocationUsecase.RememberAgent(item.CustomerID, availableAgent.ID, w.stickyTTL); err != nil {
+			logger.Printf("Failed to remember agent for customer %s: %v", item.CustomerID, err)
+		}
+	}
+
+	// 13. Record and log successful assignment
+	channel := usecase.ChannelLabel(item.Channel)
+	assignedTotal.WithLabelValues(channel).Inc()
+	assignmentLatency.WithLabelValues(channel).Observe(time.Since(item.Timestamp).Seconds())
+
+	logger.Printf("Successfully assigned agent %s to customer %s (room: %s)",
+		availableAgent.ID, item.CustomerID, item.RoomID)
+	return outcomeAssigned
+}
+
+// retryLater keeps the item out of the queue for an exponential backoff and
+// acks the in-flight copy. It returns to its place in the queue afterwards.
+func (w *WorkerService) retryLater(logger *log.Logger, item entity.QueueItem, queueData string, reason string) {
+	item.Retries++
+	item.LastError = reason
+
+	delay := w.backoff(item.Retries)
+	err := w.allocationUsecase.DelayQueueItem(item, time.Now().Add(delay))
+	if errors.Is(err, usecase.ErrRoomClosed) {
+		w.dropClosed(logger, item, queueData)
+		return
+	}
+	if err != nil {
+		logger.Printf("Failed to schedule retry: %v", err)
+		w.releaseQueueItem(logger, item)
+		return
+	}
+
+	w.ackQueueItem(logger, queueData)
+	logger.Printf("Retrying room %s in %s (retry %d): %s", item.RoomID, delay.Round(time.Millisecond), item.Retries, reason)
+}
+
+// failAssignment counts a failed assignment and moves the item to the
+// dead-letter queue once it failed maxAttempts times, otherwise retries later
+func (w *WorkerService) failAssignment(logger *log.Logger, item entity.QueueItem, queueData string, err error) {
+	item.Attempts++
+
+	if w.maxAttempts <= 0 || item.Attempts < w.maxAttempts {
+		w.retryLater(logger, item, queueData, err.Error())
 		return
 	}
 
-	// 6. Update agent capacity
-	err = w.allocationUsecase.IncrementAgentCapacity(availableAgent.ID)
+	item.LastError = err.Error()
+	if err := w.allocationUsecase.DeadLetterQueueItem(item); err != nil {
+		logger.Printf("Failed to dead-letter item: %v", err)
+		w.releaseQueueItem(logger, item)
+		return
+	}
+
+	w.ackQueueItem(logger, queueData)
+	logger.Printf("Room %s failed assignment %d times, moved to dead-letter queue: %v", item.RoomID, item.Attempts, err)
+}
+
+// holdForSegment keeps the item out of the queue until its paused channel
+// resumes. Unlike a retry it keeps its original score and retry count, so the
+// channel's customers return together in their order.
+func (w *WorkerService) holdForSegment(logger *log.Logger, item entity.QueueItem, queueData string, until time.Time) {
+	err := w.allocationUsecase.DelayQueueItem(item, until)
+	if errors.Is(err, usecase.ErrRoomClosed) {
+		w.dropClosed(logger, item, queueData)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to update agent capacity: %v", err)
+		logger.Printf("Failed to hold item until channel resumes: %v", err)
+		w.releaseQueueItem(logger, item)
+		return
 	}
 
-	// 7. Log successful assignment
-	log.Printf("Successfully assigned agent %s to customer %s (room: %s)",
-		availableAgent.ID, item.CustomerID, item.RoomID)
+	w.ackQueueItem(logger, queueData)
+	logger.Printf("Holding room %s until channel %s resumes at %s", item.RoomID, item.Channel, until.Format(time.RFC3339))
 }
 
-func (w *WorkerService) findAvailableAgent(agents []entity.Agent) *entity.Agent {
-	maxCapacity := 2
-	var selectedAgent *entity.Agent
-	minLoad := maxCapacity + 1
+// pauseSegment pauses the channel after no agent could take its customer and
+// returns when it resumes. Workers failing during the same pause share it,
+// otherwise the pause grows by the retry backoff.
+func (w *WorkerService) pauseSegment(logger *log.Logger, channel string) time.Time {
+	w.pausesMu.Lock()
+	defer w.pausesMu.Unlock()
+
+	key := strings.ToLower(channel)
+	pause := w.pauses[key]
+	if time.Now().Before(pause.until) {
+		return pause.until
+	}
+
+	pause.failures++
+	delay := w.backoff(pause.failures)
+	pause.until = time.Now().Add(delay)
+	w.pauses[key] = pause
+
+	logger.Printf("Pausing channel %s for %s (pause %d)", channel, delay.Round(time.Millisecond), pause.failures)
+	return pause.until
+}
+
+// pausedUntil returns when the channel resumes if it is paused
+func (w *WorkerService) pausedUntil(channel string) (time.Time, bool) {
+	w.pausesMu.Lock()
+	defer w.pausesMu.Unlock()
+
+	pause, ok := w.pauses[strings.ToLower(channel)]
+	if !ok || !time.Now().Before(pause.until) {
+		return time.Time{}, false
+	}
+
+	return pause.until, true
+}
+
+// resumeSegment resets the channel's pause backoff after an assignment
+func (w *WorkerService) resumeSegment(channel string) {
+	w.pausesMu.Lock()
+	defer w.pausesMu.Unlock()
+
+	delete(w.pauses, strings.ToLower(channel))
+}
+
+// backoff returns the delay before the given retry: retryBaseDelay doubled
+// per retry up to retryMaxDelay, with jitter in the upper half so items that
+// failed together don't come back together
+func (w *WorkerService) backoff(retry int) time.Duration {
+	delay := w.retryBaseDelay
+	for i := 1; i < retry && delay < w.retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.retryMaxDelay {
+		delay = w.retryMaxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// delayUntilOpen keeps the item out of the queue until its segment opens,
+// sending the after-hours reply the first time
+func (w *WorkerService) delayUntilOpen(logger *log.Logger, item entity.QueueItem, queueData string, opensAt time.Time, message string) {
+	if message != "" && !item.AfterHoursNotified {
+		if err := w.allocationUsecase.SendMessage(item.RoomID, message); err != nil {
+			logger.Printf("Failed to send after-hours reply: %v", err)
+		} else {
+			item.AfterHoursNotified = true
+		}
+	}
+
+	err := w.allocationUsecase.DelayQueueItem(item, opensAt)
+	if errors.Is(err, usecase.ErrRoomClosed) {
+		w.dropClosed(logger, item, queueData)
+		return
+	}
+	if err != nil {
+		logger.Printf("Failed to delay item until business hours: %v", err)
+		w.releaseQueueItem(logger, item)
+		return
+	}
+
+	w.ackQueueItem(logger, queueData)
+	logger.Printf("Room %s is outside business hours, delayed until %s", item.RoomID, opensAt.Format(time.RFC3339))
+}
+
+// releaseQueueItem gives back an item that could not be delayed or
+// dead-lettered. The reliable queue recovers it after the visibility timeout,
+// otherwise it is pushed back right away as the pop removed it.
+func (w *WorkerService) releaseQueueItem(logger *log.Logger, item entity.QueueItem) {
+	if err := w.allocationUsecase.ReleaseQueueItem(item); err != nil {
+		logger.Printf("Failed to put room %s back in the queue, customer %s is lost: %v", item.RoomID, item.CustomerID, err)
+	}
+}
+
+func (w *WorkerService) ackQueueItem(logger *log.Logger, queueData string) {
+	if err := w.allocationUsecase.AckQueueItem(queueData); err != nil {
+		logger.Printf("Failed to ack queue item: %v", err)
+	}
+}
+
+// filterBySkill returns the agents whose skills include the item's channel.
+// Agents without skills form the generalist pool, which is added once the
+// item has waited skillFallbackWait, whether or not a specialist is online.
+// When no online agent has skills configured, every agent is eligible.
+func (w *WorkerService) filterBySkill(logger *log.Logger, agents []entity.Agent, item entity.QueueItem) []entity.Agent {
+	channel := strings.ToLower(item.Channel)
+
+	var specialists, generalists []entity.Agent
+	for _, agent := range agents {
+		skills, err := w.allocationUsecase.GetAgentSkills(agent.ID)
+		if err != nil {
+			logger.Printf("Failed to get skills for agent %s: %v", agent.ID, err)
+			continue
+		}
+
+		if len(skills) == 0 {
+			generalists = append(generalists, agent)
+			continue
+		}
+
+		for _, skill := range skills {
+			if skill == channel {
+				specialists = append(specialists, agent)
+				break
+			}
+		}
+	}
+
+	// Skills aren't in use
+	if len(generalists) == len(agents) {
+		return generalists
+	}
+
+	waited := time.Since(item.Timestamp)
+	if waited < w.skillFallbackWait || len(generalists) == 0 {
+		return specialists
+	}
+
+	logger.Printf("Room %s waited %s, adding %d generalist agents",
+		item.RoomID, waited.Round(time.Second), len(generalists))
+	return append(specialists, generalists...)
+}
+
+// reserveCandidateAgent reserves a slot on the candidate agent Qiscus suggested
+// in the webhook, if that agent is among the eligible agents and has free
+// capacity. Every outcome is logged with a "Candidate agent" prefix so the
+// hints can be compared against the allocation strategy.
+func (w *WorkerService) reserveCandidateAgent(logger *log.Logger, agents []entity.Agent, item entity.QueueItem) *entity.Agent {
+	if item.CandidateAgentID == "" {
+		return nil
+	}
+
+	for _, agent := range agents {
+		if agent.ID != item.CandidateAgentID {
+			continue
+		}
+
+		reserved, err := w.allocationUsecase.ReserveAgentSlot(agent.ID, item.RoomID, item.Timestamp)
+		if err != nil {
+			logger.Printf("Candidate agent %s for room %s: failed to reserve slot: %v", agent.ID, item.RoomID, err)
+			return nil
+		}
+
+		if !reserved {
+			logger.Printf("Candidate agent %s for room %s: at capacity, falling back to %s strategy",
+				agent.ID, item.RoomID, w.strategy.Name())
+			return nil
+		}
+
+		logger.Printf("Candidate agent %s for room %s: accepted", agent.ID, item.RoomID)
+		return &agent
+	}
+
+	logger.Printf("Candidate agent %s for room %s: offline or not eligible for channel %s, falling back to %s strategy",
+		item.CandidateAgentID, item.RoomID, item.Channel, w.strategy.Name())
+	return nil
+}
+
+// reservePreviousAgent reserves a slot on the agent who last served the
+// customer, if that agent is among the eligible agents and has free capacity
+func (w *WorkerService) reservePreviousAgent(logger *log.Logger, agents []entity.Agent, item entity.QueueItem) *entity.Agent {
+	if w.stickyTTL <= 0 {
+		return nil
+	}
+
+	previousID, err := w.allocationUsecase.GetPreviousAgent(item.CustomerID)
+	if err != nil {
+		logger.Printf("Failed to get previous agent for customer %s: %v", item.CustomerID, err)
+		return nil
+	}
+
+	if previousID == "" {
+		return nil
+	}
 
+	for _, agent := range agents {
+		if agent.ID != previousID {
+			continue
+		}
+
+		reserved, err := w.allocationUsecase.ReserveAgentSlot(agent.ID, item.RoomID, item.Timestamp)
+		if err != nil {
+			logger.Printf("Failed to reserve slot for agent %s: %v", agent.ID, err)
+			return nil
+		}
+
+		if !reserved {
+			logger.Printf("Previous agent %s of customer %s is at capacity", agent.ID, item.CustomerID)
+			return nil
+		}
+
+		logger.Printf("Routing customer %s back to previous agent %s", item.CustomerID, agent.ID)
+		return &agent
+	}
+
+	return nil
+}
+
+// findAvailableAgent lets the allocation strategy rank agents below their max
+// capacity and reserves a slot for the room on the first one. If another worker
+// takes the last slot first, the next agent in the ranking is tried.
+func (w *WorkerService) findAvailableAgent(logger *log.Logger, agents []entity.Agent, item entity.QueueItem) *entity.Agent {
+	var candidates []usecase.AgentCandidate
 	for _, agent := range agents {
 		currentCapacity, err := w.allocationUsecase.GetAgentCapacity(agent.ID)
 		if err != nil {
-			log.Printf("Failed to get capacity for agent %s: %v", agent.ID, err)
+			logger.Printf("Failed to get capacity for agent %s: %v", agent.ID, err)
+			continue
+		}
+
+		maxCapacity, err := w.allocationUsecase.GetAgentMaxCapacity(agent.ID)
+		if err != nil {
+			logger.Printf("Failed to get max capacity for agent %s: %v", agent.ID, err)
 			continue
 		}
 
-		if currentCapacity < maxCapacity && currentCapacity < minLoad {
-			selectedAgent = &agent
-			minLoad = currentCapacity
+		if currentCapacity < maxCapacity {
+			candidates = append(candidates, usecase.AgentCandidate{
+				Agent:       agent,
+				Load:        currentCapacity,
+				MaxCapacity: maxCapacity,
+			})
 		}
 	}
 
-	return selectedAgent
+	ordered, err := w.strategy.Order(candidates)
+	if err != nil {
+		logger.Printf("Failed to rank agents with %s strategy: %v", w.strategy.Name(), err)
+		return nil
+	}
+
+	for _, c := range ordered {
+		reserved, err := w.allocationUsecase.ReserveAgentSlot(c.Agent.ID, item.RoomID, item.Timestamp)
+		if errors.Is(err, usecase.ErrRoomClosed) {
+			return nil
+		}
+		if err != nil {
+			logger.Printf("Failed to reserve slot for agent %s: %v", c.Agent.ID, err)
+			continue
+		}
+
+		if reserved {
+			agent := c.Agent
+			return &agent
+		}
+	}
+
+	return nil
+}
+
+// skipClosed acks the item if its room was resolved or manually assigned
+// after it was queued. A failed check lets the item through.
+func (w *WorkerService) skipClosed(logger *log.Logger, item entity.QueueItem, queueData string) bool {
+	closed, err := w.allocationUsecase.IsClosed(item)
+	if err != nil {
+		logger.Printf("Failed to check if room %s is closed: %v", item.RoomID, err)
+		return false
+	}
+
+	if !closed {
+		return false
+	}
+
+	w.dropClosed(logger, item, queueData)
+	return true
+}
+
+// dropClosed acks the item of a room resolved or manually assigned after it was queued
+func (w *WorkerService) dropClosed(logger *log.Logger, item entity.QueueItem, queueData string) {
+	logger.Printf("Room %s was resolved or assigned outside the queue, skipping", item.RoomID)
+	w.ackQueueItem(logger, queueData)
+}
+
+// sleep waits for d or until ctx is cancelled, whichever comes first
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
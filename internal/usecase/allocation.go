@@ -1,43 +1,174 @@
 package usecase
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"qiscus-agent-allocation/internal/domain/entity"
 	"qiscus-agent-allocation/internal/repository/qiscus"
 	"qiscus-agent-allocation/internal/repository/redis"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	enqueuedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_enqueued_total",
+		Help: "Customers added to the queue, by channel.",
+	}, []string{"channel"})
+	agentLoad = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "agent_load",
+		Help: "Customers an agent currently holds, as last seen by this instance.",
+	}, []string{"agent_id"})
+	agentMaxCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "agent_max_capacity",
+		Help: "Max customers an agent can hold, as last seen by this instance.",
+	}, []string{"agent_id"})
 )
 
+// metricChannels are the webhook sources kept as channel labels, any other
+// source is counted as "other" so stray values can't add series
+var metricChannels = map[string]bool{
+	"qiscus": true, "wa": true, "whatsapp": true, "ig": true, "instagram": true,
+	"fb": true, "facebook": true, "line": true, "telegram": true, "twitter": true,
+	"email": true, "custom": true,
+}
+
+// ChannelLabel returns the metric label for a channel
+func ChannelLabel(channel string) string {
+	channel = strings.ToLower(channel)
+	if metricChannels[channel] {
+		return channel
+	}
+
+	return "other"
+}
+
 type AllocationUsecase interface {
 	IsInQueue(roomID, channel, customerID string) (bool, error)
 	AddToQueue(item entity.QueueItem) error
-	GetFromQueue() (string, error)
+	GetFromQueue(ctx context.Context, timeout time.Duration) (string, error)
+	MigrateLegacyQueue() (int, error)
+	AckQueueItem(data string) error
+	ExtendQueueItem(data string) (bool, error)
+	RequeueExpiredItems() (int, error)
+	DelayQueueItem(item entity.QueueItem, until time.Time) error
+	PromoteDelayedItems() (int, error)
+	ReleaseQueueItem(item entity.QueueItem) error
+
+	// Dead-letter operations
+	DeadLetterQueueItem(item entity.QueueItem) error
+	ListDeadLetters() ([]entity.QueueItem, error)
+	RetryDeadLetter(roomID string) (*entity.QueueItem, error)
+	PurgeDeadLetter(roomID string) error
+	PurgeDeadLetters() (int, error)
+	SetQueuePriority(roomID, channel, customerID string, priority int) (*entity.QueueItem, error)
+	GetQueueStats() (*entity.QueueStats, error)
+	ListQueueEntries() ([]entity.QueueEntry, error)
+	FindQueueEntry(roomID, customerID string) (*entity.QueueEntry, error)
+	RemoveFromQueue(roomID string) (int, error)
+	DropResolvedRoom(roomID string) (int, error)
+	IsClosed(item entity.QueueItem) (bool, error)
+	MoveToFront(roomID string) (*entity.QueueItem, error)
+	RequestQueueFlush() (string, error)
+	FlushQueue(token string) (int, error)
+	GetQueuePosition(roomID, channel, customerID string) (int, error)
+	GetWaitPerPosition() (time.Duration, error)
 
 	// Agent operations
 	GetOnlineAgents() ([]entity.Agent, error)
+	GetOnlineAgentsForChannel(channel string) ([]entity.Agent, error)
+	GetAllAgents() ([]entity.Agent, error)
 	AssignAgent(roomID, agentID string) error
+	SendMessage(roomID, message string) error
 	GetAgentCapacity(agentID string) (int, error)
-	IncrementAgentCapacity(agentID string) error
-	DecrementAgentCapacity(agentID string) error
+	ReserveAgentSlot(agentID, roomID string, queuedAt time.Time) (bool, error)
+	ReleaseAgentSlot(agentID, roomID string) (int, error)
+	ResolveRoom(roomID, resolvedByAgentID string) (string, int, error)
+	GetAgentMaxCapacity(agentID string) (int, error)
+	SetAgentMaxCapacity(agentID string, maxCapacity int) error
+	ResetAgentMaxCapacity(agentID string) error
+	GetAgentCapacityInfo(agentID string) (*entity.AgentCapacity, error)
+	ReconcileAgentRooms(agentID string) (*entity.CapacityCorrection, error)
+	ManualAssign(roomID, agentID, actor, remoteAddr string) (*entity.ManualAssignment, error)
+	ListAuditLog(limit int) ([]entity.AuditEntry, error)
+	GetAgentSkills(agentID string) ([]string, error)
+	GetPreviousAgent(customerID string) (string, error)
+	RememberAgent(customerID, agentID string, ttl time.Duration) error
+	SetAgentSkills(agentID string, skills []string) error
 }
 
+// waitEstimateWindow is the period of recent assignments used to estimate waiting time
+const waitEstimateWindow = 30 * time.Minute
+
+// ErrNotInQueue is returned when an operation targets an item that is not queued
+var ErrNotInQueue = errors.New("item is not in queue")
+
+// ErrInvalidFlushToken is returned when a flush is not confirmed with the current token
+var ErrInvalidFlushToken = errors.New("invalid or expired flush confirmation token")
+
+// closedMarkerTTL is how long a room resolved or manually assigned is
+// remembered so in-flight items queued before that are skipped
+const closedMarkerTTL = time.Hour
+
+// flushTokenTTL is how long a flush confirmation token stays valid
+const flushTokenTTL = time.Minute
+
+// ErrNotDeadLettered is returned when no dead-lettered item matches
+var ErrNotDeadLettered = errors.New("item is not in dead-letter queue")
+
+// ErrAlreadyAssigned is returned when a room is manually assigned to the agent already holding it
+var ErrAlreadyAssigned = errors.New("room is already assigned to this agent")
+
+// ErrRoomClosed is returned when reserving a slot for or delaying a room that
+// was resolved or manually assigned after it was queued
+var ErrRoomClosed = errors.New("room was closed after it was queued")
+
+// Audit log actions
+const (
+	AuditActionAssign   = "assign"
+	AuditActionReassign = "reassign"
+)
+
+// reconcileGracePeriod is how long a reserved room is kept by reconciliation
+// even though Qiscus doesn't list it, covering the assignment in progress
+const reconcileGracePeriod = 2 * time.Minute
+
+// moveRoomAttempts bounds retries when the room changes agent while being moved
+const moveRoomAttempts = 3
+
 type allocationUsecase struct {
 	agentRepo       redis.AgentRepository
 	queueRepo       redis.QueueRepository
 	agentQiscusRepo qiscus.AgentQiscusRepository
+	priorityRules   PriorityRules
+	divisionRoutes  DivisionRoutes
+	auditRepo       redis.AuditRepository
 }
 
 func NewAllocationUsecase(
 	agentRepo redis.AgentRepository,
 	queueRepo redis.QueueRepository,
 	agentQiscusRepo qiscus.AgentQiscusRepository,
+	priorityRules PriorityRules,
+	divisionRoutes DivisionRoutes,
+	auditRepo redis.AuditRepository,
 ) AllocationUsecase {
 	return &allocationUsecase{
 		agentRepo:       agentRepo,
 		queueRepo:       queueRepo,
 		agentQiscusRepo: agentQiscusRepo,
+		priorityRules:   priorityRules,
+		divisionRoutes:  divisionRoutes,
+		auditRepo:       auditRepo,
 	}
 }
 
@@ -50,26 +181,421 @@ func (u *allocationUsecase) IsInQueue(roomID, channel, customerID string) (bool,
 }
 
 func (u *allocationUsecase) AddToQueue(item entity.QueueItem) error {
+	// Priority rules can only raise the priority
+	if priority := u.priorityRules.PriorityFor(item); priority > item.Priority {
+		item.Priority = priority
+	}
+
 	// Convert to JSON string
 	data, err := json.Marshal(item)
 	if err != nil {
 		return fmt.Errorf("failed to marshal queue item: %w", err)
 	}
 
-	// Add to Redis queue (LPUSH for FIFO)
-	err = u.queueRepo.Push(string(data))
+	// Add to Redis queue, ordered by priority then timestamp
+	err = u.queueRepo.Push(string(data), queueScore(item))
 	if err != nil {
 		return fmt.Errorf("failed to push to queue: %w", err)
 	}
 
+	enqueuedTotal.WithLabelValues(ChannelLabel(item.Channel)).Inc()
 	log.Printf("Added to queue: %s", string(data))
 	return nil
 }
 
-// GetFromQueue gets next customer from Redis queue (FIFO)
-func (u *allocationUsecase) GetFromQueue() (string, error) {
-	// Get from Redis queue (RPOP for FIFO)
-	data, err := u.queueRepo.Pop()
+// MigrateLegacyQueue moves the customers left in the chat_queue list of
+// older versions into the queue, keeping their original timestamps so they
+// keep their place. An item is removed from the legacy list only after it is
+// queued, so an interrupted migration at worst queues it again, which is a no-op.
+func (u *allocationUsecase) MigrateLegacyQueue() (int, error) {
+	count := 0
+	for {
+		data, err := u.queueRepo.PeekLegacy()
+		if err != nil {
+			return count, fmt.Errorf("failed to read legacy queue: %w", err)
+		}
+
+		if data == "" {
+			return count, nil
+		}
+
+		var item entity.QueueItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			log.Printf("Dropping malformed legacy queue item: %s", data)
+		} else if err := u.AddToQueue(item); err != nil {
+			return count, err
+		} else {
+			count++
+		}
+
+		if err := u.queueRepo.RemoveLegacy(data); err != nil {
+			return count, fmt.Errorf("failed to remove legacy queue item: %w", err)
+		}
+	}
+}
+
+// GetQueueStats counts the items in each part of the queue
+func (u *allocationUsecase) GetQueueStats() (*entity.QueueStats, error) {
+	stats, err := u.queueRepo.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// ListQueueEntries returns the customers being assigned, then the queued and
+// delayed ones in allocation order with their position, each with its state
+// and how long it has waited. Delayed customers are placed by the priority
+// they return with.
+func (u *allocationUsecase) ListQueueEntries() ([]entity.QueueEntry, error) {
+	list, err := u.queueRepo.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queue: %w", err)
+	}
+
+	now := time.Now()
+	position := 0
+	entries := make([]entity.QueueEntry, 0, len(list))
+	for _, listed := range list {
+		var item entity.QueueItem
+		if err := json.Unmarshal([]byte(listed.Data), &item); err != nil {
+			log.Printf("Skipping malformed queue item: %s", listed.Data)
+			continue
+		}
+
+		entry := entity.QueueEntry{
+			QueueItem:   item,
+			State:       listed.State,
+			WaitSeconds: int64(now.Sub(item.Timestamp).Seconds()),
+		}
+		if listed.State != entity.QueueStateInFlight {
+			position++
+			entry.Position = position
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// FindQueueEntry returns the first entry of the room or customer, in any state
+func (u *allocationUsecase) FindQueueEntry(roomID, customerID string) (*entity.QueueEntry, error) {
+	entries, err := u.ListQueueEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if (roomID != "" && entry.RoomID == roomID) ||
+			(customerID != "" && strings.EqualFold(entry.CustomerID, customerID)) {
+			return &entry, nil
+		}
+	}
+
+	return nil, ErrNotInQueue
+}
+
+// RemoveFromQueue drops the room's waiting or delayed entries and returns how
+// many were removed
+func (u *allocationUsecase) RemoveFromQueue(roomID string) (int, error) {
+	removed, err := u.queueRepo.RemoveRoom(roomID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove room from queue: %w", err)
+	}
+
+	if removed > 0 {
+		log.Printf("Removed room %s from queue", roomID)
+	}
+
+	return removed, nil
+}
+
+// DropResolvedRoom marks the room resolved and removes it from the queue.
+// Returns the number of removed items.
+func (u *allocationUsecase) DropResolvedRoom(roomID string) (int, error) {
+	// Mark first so a worker that already popped the room skips it
+	if err := u.queueRepo.MarkClosed(roomID, time.Now(), closedMarkerTTL); err != nil {
+		return 0, fmt.Errorf("failed to mark room closed: %w", err)
+	}
+
+	return u.RemoveFromQueue(roomID)
+}
+
+// IsClosed reports whether the item's room was resolved or manually assigned
+// after it was queued
+func (u *allocationUsecase) IsClosed(item entity.QueueItem) (bool, error) {
+	closedAt, err := u.queueRepo.ClosedAt(item.RoomID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if room is closed: %w", err)
+	}
+
+	return !closedAt.IsZero() && item.Timestamp.UnixMilli() <= closedAt.UnixMilli(), nil
+}
+
+// MoveToFront raises the room's priority just above the first queued or
+// delayed customer, so it is allocated next and keeps its place if it has to
+// be retried. A delayed room still waits until it is due.
+func (u *allocationUsecase) MoveToFront(roomID string) (*entity.QueueItem, error) {
+	entries, err := u.ListQueueEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var head *entity.QueueEntry
+	for i, entry := range entries {
+		// Rooms being assigned can't be moved
+		if entry.State == entity.QueueStateInFlight {
+			continue
+		}
+
+		if head == nil {
+			head = &entries[i]
+		}
+
+		if entry.RoomID != roomID {
+			continue
+		}
+
+		if head == &entries[i] {
+			return &entry.QueueItem, nil
+		}
+
+		return u.SetQueuePriority(entry.RoomID, entry.Channel, entry.CustomerID, head.Priority+1)
+	}
+
+	return nil, ErrNotInQueue
+}
+
+// RequestQueueFlush issues the token that confirms a queue flush
+func (u *allocationUsecase) RequestQueueFlush() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate flush token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	if err := u.queueRepo.SetFlushToken(token, flushTokenTTL); err != nil {
+		return "", fmt.Errorf("failed to request queue flush: %w", err)
+	}
+
+	return token, nil
+}
+
+// FlushQueue drops every waiting and delayed customer, confirmed by the token
+// from RequestQueueFlush. In-flight items and dead letters are kept.
+func (u *allocationUsecase) FlushQueue(token string) (int, error) {
+	count, err := u.queueRepo.Flush(token)
+	if err != nil {
+		return 0, fmt.Errorf("failed to flush queue: %w", err)
+	}
+
+	if count < 0 {
+		return 0, ErrInvalidFlushToken
+	}
+
+	log.Printf("Flushed %d items from queue", count)
+	return count, nil
+}
+
+// GetQueuePosition returns the 1-based position of a queued or delayed
+// customer, 0 when the customer is not waiting (being allocated or not queued)
+func (u *allocationUsecase) GetQueuePosition(roomID, channel, customerID string) (int, error) {
+	rank, err := u.queueRepo.Rank(roomID, channel, customerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue position: %w", err)
+	}
+
+	return int(rank) + 1, nil
+}
+
+// GetWaitPerPosition estimates how long each place in the queue takes from
+// the assignments of the last waitEstimateWindow, 0 when there were none
+func (u *allocationUsecase) GetWaitPerPosition() (time.Duration, error) {
+	count, err := u.agentRepo.CountAssignmentsSince(time.Now().Add(-waitEstimateWindow))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get recent assignments: %w", err)
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	return waitEstimateWindow / time.Duration(count), nil
+}
+
+// DelayQueueItem keeps a popped item out of the queue until the given time,
+// after which it returns with its original priority and timestamp. Returns
+// ErrRoomClosed instead if the room was resolved or manually assigned after
+// the item was queued, as the closed marker may be gone by then.
+func (u *allocationUsecase) DelayQueueItem(item entity.QueueItem, until time.Time) error {
+	// Keep a priority set by an admin while the item was in flight
+	stored, err := u.queueRepo.Get(item.RoomID, item.Channel, item.CustomerID)
+	if err != nil {
+		log.Printf("Failed to get queue item of room %s, keeping its priority: %v", item.RoomID, err)
+	}
+	if stored != "" {
+		var current entity.QueueItem
+		if err := json.Unmarshal([]byte(stored), &current); err == nil {
+			item.Priority = current.Priority
+		}
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	err = u.queueRepo.Delay(string(data), queueScore(item), until)
+	if errors.Is(err, redis.ErrRoomClosed) {
+		return ErrRoomClosed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delay queue item: %w", err)
+	}
+
+	log.Printf("Delayed until %s: %s", until.Format(time.RFC3339), string(data))
+	return nil
+}
+
+// PromoteDelayedItems moves delayed items that are due back to the queue
+func (u *allocationUsecase) PromoteDelayedItems() (int, error) {
+	count, err := u.queueRepo.PromoteDelayed()
+	if err != nil {
+		return 0, fmt.Errorf("failed to promote delayed items: %w", err)
+	}
+
+	if count > 0 {
+		log.Printf("Moved %d delayed items back to queue", count)
+	}
+
+	return count, nil
+}
+
+// DeadLetterQueueItem gives up on an item, moving it to the dead-letter queue
+func (u *allocationUsecase) DeadLetterQueueItem(item entity.QueueItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	if err := u.queueRepo.DeadLetter(string(data)); err != nil {
+		return fmt.Errorf("failed to dead-letter queue item: %w", err)
+	}
+
+	log.Printf("Dead-lettered: %s", string(data))
+	return nil
+}
+
+// ListDeadLetters returns the dead-lettered items, oldest first
+func (u *allocationUsecase) ListDeadLetters() ([]entity.QueueItem, error) {
+	list, err := u.queueRepo.ListDead()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead-letter queue: %w", err)
+	}
+
+	items := make([]entity.QueueItem, 0, len(list))
+	for _, data := range list {
+		var item entity.QueueItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			log.Printf("Skipping malformed dead-lettered item: %s", data)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// findDeadLetter returns the raw data and item of the dead-lettered room
+func (u *allocationUsecase) findDeadLetter(roomID string) (string, *entity.QueueItem, error) {
+	list, err := u.queueRepo.ListDead()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list dead-letter queue: %w", err)
+	}
+
+	for _, data := range list {
+		var item entity.QueueItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			continue
+		}
+
+		if item.RoomID == roomID {
+			return data, &item, nil
+		}
+	}
+
+	return "", nil, ErrNotDeadLettered
+}
+
+// RetryDeadLetter puts a dead-lettered room back in the queue with its
+// failure counters reset. It keeps its original place in the queue.
+func (u *allocationUsecase) RetryDeadLetter(roomID string) (*entity.QueueItem, error) {
+	deadData, item, err := u.findDeadLetter(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Retries = 0
+	item.Attempts = 0
+	item.LastError = ""
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	ok, err := u.queueRepo.RequeueDead(deadData, string(data), queueScore(*item))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retry dead-lettered item: %w", err)
+	}
+
+	// Retried or purged concurrently
+	if !ok {
+		return nil, ErrNotDeadLettered
+	}
+
+	log.Printf("Retrying dead-lettered: %s", string(data))
+	return item, nil
+}
+
+// PurgeDeadLetter drops a dead-lettered room
+func (u *allocationUsecase) PurgeDeadLetter(roomID string) error {
+	deadData, _, err := u.findDeadLetter(roomID)
+	if err != nil {
+		return err
+	}
+
+	removed, err := u.queueRepo.RemoveDead(deadData)
+	if err != nil {
+		return fmt.Errorf("failed to purge dead-lettered item: %w", err)
+	}
+
+	if !removed {
+		return ErrNotDeadLettered
+	}
+
+	return nil
+}
+
+// PurgeDeadLetters drops every dead-lettered item
+func (u *allocationUsecase) PurgeDeadLetters() (int, error) {
+	count, err := u.queueRepo.PurgeDead()
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead-letter queue: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetFromQueue waits up to timeout for the next customer from Redis queue
+// (highest priority, then FIFO). Returns an empty string when the queue stayed empty.
+func (u *allocationUsecase) GetFromQueue(ctx context.Context, timeout time.Duration) (string, error) {
+	data, err := u.queueRepo.BlockingPop(ctx, timeout)
+	if errors.Is(err, redis.ErrQueueEmpty) {
+		return "", nil
+	}
+
 	if err != nil {
 		return "", fmt.Errorf("failed to pop from queue: %w", err)
 	}
@@ -77,6 +603,94 @@ func (u *allocationUsecase) GetFromQueue() (string, error) {
 	return data, nil
 }
 
+// SetQueuePriority changes the priority of a queued customer and moves it
+// accordingly. Delayed and in-flight customers keep the new priority when
+// they return to the queue.
+func (u *allocationUsecase) SetQueuePriority(roomID, channel, customerID string, priority int) (*entity.QueueItem, error) {
+	data, err := u.queueRepo.Get(roomID, channel, customerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queue item: %w", err)
+	}
+
+	if data == "" {
+		return nil, ErrNotInQueue
+	}
+
+	var item entity.QueueItem
+	if err := json.Unmarshal([]byte(data), &item); err != nil {
+		return nil, fmt.Errorf("failed to parse queue item: %w", err)
+	}
+
+	item.Priority = priority
+	updated, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	ok, err := u.queueRepo.Update(string(updated), queueScore(item))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update queue item: %w", err)
+	}
+
+	// Item was assigned or removed meanwhile
+	if !ok {
+		return nil, ErrNotInQueue
+	}
+
+	log.Printf("Set priority of room %s to %d", roomID, priority)
+	return &item, nil
+}
+
+// AckQueueItem marks a popped queue item as done so it is not recovered later
+func (u *allocationUsecase) AckQueueItem(data string) error {
+	err := u.queueRepo.Ack(data)
+	if err != nil {
+		return fmt.Errorf("failed to ack queue item: %w", err)
+	}
+
+	return nil
+}
+
+// ExtendQueueItem renews the visibility timeout of a popped item. Returns
+// false when the item is no longer in flight.
+func (u *allocationUsecase) ExtendQueueItem(data string) (bool, error) {
+	extended, err := u.queueRepo.Extend(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to extend queue item: %w", err)
+	}
+
+	return extended, nil
+}
+
+// ReleaseQueueItem gives back a popped item that could not be delayed or
+// dead-lettered, so the customer stays in the queue
+func (u *allocationUsecase) ReleaseQueueItem(item entity.QueueItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	if err := u.queueRepo.Release(string(data), queueScore(item)); err != nil {
+		return fmt.Errorf("failed to release queue item: %w", err)
+	}
+
+	return nil
+}
+
+// RequeueExpiredItems returns in-flight items past their visibility timeout to the queue
+func (u *allocationUsecase) RequeueExpiredItems() (int, error) {
+	count, err := u.queueRepo.RequeueExpired()
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue expired items: %w", err)
+	}
+
+	if count > 0 {
+		log.Printf("Requeued %d expired in-flight items", count)
+	}
+
+	return count, nil
+}
+
 // GetOnlineAgents fetches online agents from Qiscus API
 func (u *allocationUsecase) GetOnlineAgents() ([]entity.Agent, error) {
 	// Get agents from Qiscus API
@@ -98,6 +712,51 @@ func (u *allocationUsecase) GetOnlineAgents() ([]entity.Agent, error) {
 	return agents, nil
 }
 
+// GetOnlineAgentsForChannel fetches online agents of the divisions routed to
+// the channel, or all online agents when the channel has no route
+func (u *allocationUsecase) GetOnlineAgentsForChannel(channel string) ([]entity.Agent, error) {
+	divisions := u.divisionRoutes.DivisionsFor(channel)
+	if len(divisions) == 0 {
+		return u.GetOnlineAgents()
+	}
+
+	qiscusAgents, err := u.agentQiscusRepo.GetOnlineAgentsByDivision(divisions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get online agents for divisions %v: %w", divisions, err)
+	}
+
+	var agents []entity.Agent
+	for _, qAgent := range qiscusAgents {
+		agents = append(agents, entity.Agent{
+			ID:          fmt.Sprintf("%d", qAgent.ID),
+			Name:        qAgent.Name,
+			IsAvailable: qAgent.IsAvailable,
+		})
+	}
+
+	return agents, nil
+}
+
+// GetAllAgents fetches all agents, online or not, from Qiscus API
+func (u *allocationUsecase) GetAllAgents() ([]entity.Agent, error) {
+	qiscusAgents, err := u.agentQiscusRepo.GetAllAgents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agents: %w", err)
+	}
+
+	var agents []entity.Agent
+	for _, qAgent := range qiscusAgents {
+		agents = append(agents, entity.Agent{
+			ID:          fmt.Sprintf("%d", qAgent.ID),
+			Name:        qAgent.Name,
+			Email:       qAgent.Email,
+			IsAvailable: qAgent.IsAvailable,
+		})
+	}
+
+	return agents, nil
+}
+
 // AssignAgent assigns agent to customer via Qiscus API
 func (u *allocationUsecase) AssignAgent(roomID, agentID string) error {
 	// Call Qiscus API to assign agent
@@ -106,10 +765,24 @@ func (u *allocationUsecase) AssignAgent(roomID, agentID string) error {
 		return fmt.Errorf("failed to assign agent: %w", err)
 	}
 
+	// Count the assignment for waiting time estimates
+	if err := u.agentRepo.RecordAssignment(roomID); err != nil {
+		log.Printf("Failed to record assignment of room %s: %v", roomID, err)
+	}
+
 	log.Printf("Successfully assigned agent %s to room %s", agentID, roomID)
 	return nil
 }
 
+// SendMessage posts a bot message to the customer's room
+func (u *allocationUsecase) SendMessage(roomID, message string) error {
+	if err := u.agentQiscusRepo.SendMessage(roomID, message); err != nil {
+		return fmt.Errorf("failed to send message to room %s: %w", roomID, err)
+	}
+
+	return nil
+}
+
 // GetAgentCapacity gets current agent capacity from Redis
 func (u *allocationUsecase) GetAgentCapacity(agentID string) (int, error) {
 	capacity, err := u.agentRepo.GetCapacity(agentID)
@@ -117,27 +790,403 @@ func (u *allocationUsecase) GetAgentCapacity(agentID string) (int, error) {
 		return 0, fmt.Errorf("failed to get agent capacity: %w", err)
 	}
 
+	agentLoad.WithLabelValues(agentID).Set(float64(capacity))
+	return capacity, nil
+}
+
+// ReserveAgentSlot assigns the room to the agent in Redis if it is below its
+// max capacity. Returns ErrRoomClosed if the room was resolved or manually
+// assigned after queuedAt.
+func (u *allocationUsecase) ReserveAgentSlot(agentID, roomID string, queuedAt time.Time) (bool, error) {
+	maxCapacity, err := u.agentRepo.GetMaxCapacity(agentID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get agent max capacity: %w", err)
+	}
+
+	reserved, err := u.agentRepo.ReserveSlot(agentID, roomID, maxCapacity, queuedAt)
+	if errors.Is(err, redis.ErrRoomClosed) {
+		return false, ErrRoomClosed
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve agent slot: %w", err)
+	}
+
+	agentMaxCapacity.WithLabelValues(agentID).Set(float64(maxCapacity))
+
+	if reserved {
+		log.Printf("Reserved slot for agent %s (room: %s)", agentID, roomID)
+
+		if capacity, err := u.agentRepo.GetCapacity(agentID); err == nil {
+			agentLoad.WithLabelValues(agentID).Set(float64(capacity))
+		}
+	}
+
+	return reserved, nil
+}
+
+// ReleaseAgentSlot removes the room from the agent and returns the agent's new capacity
+func (u *allocationUsecase) ReleaseAgentSlot(agentID, roomID string) (int, error) {
+	capacity, err := u.agentRepo.ReleaseSlot(agentID, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release agent slot: %w", err)
+	}
+
+	agentLoad.WithLabelValues(agentID).Set(float64(capacity))
+	log.Printf("Released slot for agent %s (room: %s), current capacity %d", agentID, roomID, capacity)
 	return capacity, nil
 }
 
-// IncrementAgentCapacity increases agent capacity by 1
-func (u *allocationUsecase) IncrementAgentCapacity(agentID string) error {
-	err := u.agentRepo.IncrementCapacity(agentID)
+// ResolveRoom frees the room from the agent holding it. The agent recorded at
+// assignment wins over the resolving agent, so a chat resolved by a supervisor
+// still frees the right slot. Resolving the same room twice is a no-op.
+func (u *allocationUsecase) ResolveRoom(roomID, resolvedByAgentID string) (string, int, error) {
+	agentID, err := u.agentRepo.GetRoomAgent(roomID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get room agent: %w", err)
+	}
+
+	if agentID == "" {
+		agentID = resolvedByAgentID
+	}
+
+	if agentID == "" {
+		return "", 0, nil
+	}
+
+	capacity, err := u.ReleaseAgentSlot(agentID, roomID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return agentID, capacity, nil
+}
+
+// GetAgentMaxCapacity gets the max number of customers an agent can handle
+func (u *allocationUsecase) GetAgentMaxCapacity(agentID string) (int, error) {
+	maxCapacity, err := u.agentRepo.GetMaxCapacity(agentID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get agent max capacity: %w", err)
+	}
+
+	agentMaxCapacity.WithLabelValues(agentID).Set(float64(maxCapacity))
+	return maxCapacity, nil
+}
+
+// SetAgentMaxCapacity sets a per-agent max capacity
+func (u *allocationUsecase) SetAgentMaxCapacity(agentID string, maxCapacity int) error {
+	if maxCapacity < 0 {
+		return fmt.Errorf("max capacity must not be negative")
+	}
+
+	err := u.agentRepo.SetMaxCapacity(agentID, maxCapacity)
+	if err != nil {
+		return fmt.Errorf("failed to set agent max capacity: %w", err)
+	}
+
+	agentMaxCapacity.WithLabelValues(agentID).Set(float64(maxCapacity))
+	log.Printf("Set max capacity for agent %s to %d", agentID, maxCapacity)
+	return nil
+}
+
+// ResetAgentMaxCapacity removes the per-agent max capacity so the default applies
+func (u *allocationUsecase) ResetAgentMaxCapacity(agentID string) error {
+	err := u.agentRepo.ResetMaxCapacity(agentID)
+	if err != nil {
+		return fmt.Errorf("failed to reset agent max capacity: %w", err)
+	}
+
+	agentMaxCapacity.WithLabelValues(agentID).Set(float64(u.agentRepo.GetDefaultMaxCapacity()))
+	log.Printf("Reset max capacity for agent %s to default (%d)", agentID, u.agentRepo.GetDefaultMaxCapacity())
+	return nil
+}
+
+// GetAgentCapacityInfo gets current load and max capacity of an agent
+func (u *allocationUsecase) GetAgentCapacityInfo(agentID string) (*entity.AgentCapacity, error) {
+	current, err := u.agentRepo.GetCapacity(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent capacity: %w", err)
+	}
+
+	maxCapacity, err := u.agentRepo.GetMaxCapacity(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent max capacity: %w", err)
+	}
+
+	rooms, err := u.agentRepo.GetRooms(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent rooms: %w", err)
+	}
+
+	agentLoad.WithLabelValues(agentID).Set(float64(current))
+	agentMaxCapacity.WithLabelValues(agentID).Set(float64(maxCapacity))
+
+	return &entity.AgentCapacity{
+		AgentID:         agentID,
+		Rooms:           rooms,
+		CurrentCapacity: current,
+		MaxCapacity:     maxCapacity,
+		DefaultCapacity: u.agentRepo.GetDefaultMaxCapacity(),
+	}, nil
+}
+
+// GetPreviousAgent gets the agent who last served the customer, empty if none
+func (u *allocationUsecase) GetPreviousAgent(customerID string) (string, error) {
+	customerID = strings.ToLower(customerID)
+
+	agentID, err := u.agentRepo.GetCustomerAgent(customerID)
 	if err != nil {
-		return fmt.Errorf("failed to increment agent capacity: %w", err)
+		return "", fmt.Errorf("failed to get previous agent: %w", err)
+	}
+
+	return agentID, nil
+}
+
+// RememberAgent records the agent serving the customer so returning customers
+// can be routed back to them within ttl
+func (u *allocationUsecase) RememberAgent(customerID, agentID string, ttl time.Duration) error {
+	customerID = strings.ToLower(customerID)
+
+	err := u.agentRepo.SetCustomerAgent(customerID, agentID, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to remember agent: %w", err)
 	}
 
-	log.Printf("Incremented capacity for agent %s", agentID)
 	return nil
 }
 
-// DecrementAgentCapacity decreases agent capacity by 1
-func (u *allocationUsecase) DecrementAgentCapacity(agentID string) error {
-	err := u.agentRepo.DecrementCapacity(agentID)
+// GetAgentSkills gets the channels an agent serves
+func (u *allocationUsecase) GetAgentSkills(agentID string) ([]string, error) {
+	skills, err := u.agentRepo.GetSkills(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent skills: %w", err)
+	}
+
+	return skills, nil
+}
+
+// SetAgentSkills sets the channels an agent serves. Channels are stored lower case.
+func (u *allocationUsecase) SetAgentSkills(agentID string, skills []string) error {
+	normalized := make([]string, 0, len(skills))
+	for _, skill := range skills {
+		skill = strings.ToLower(strings.TrimSpace(skill))
+		if skill != "" {
+			normalized = append(normalized, skill)
+		}
+	}
+
+	err := u.agentRepo.SetSkills(agentID, normalized)
 	if err != nil {
-		return fmt.Errorf("failed to decrement agent capacity: %w", err)
+		return fmt.Errorf("failed to set agent skills: %w", err)
 	}
 
-	log.Printf("Decremented capacity for agent %s", agentID)
+	log.Printf("Set skills for agent %s to %v", agentID, normalized)
 	return nil
 }
+
+// ReconcileAgentRooms compares the rooms tracked in Redis with the agent's
+// active rooms in Qiscus and corrects Redis. The tracked rooms are read first,
+// so rooms reserved or resolved while Qiscus is queried are left alone.
+// Returns nil when nothing changed.
+func (u *allocationUsecase) ReconcileAgentRooms(agentID string) (*entity.CapacityCorrection, error) {
+	snapshotAt := time.Now()
+	trackedRooms, err := u.agentRepo.GetRooms(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent rooms: %w", err)
+	}
+
+	actualRooms, err := u.agentQiscusRepo.GetActiveRooms(agentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active rooms: %w", err)
+	}
+
+	added := difference(actualRooms, trackedRooms)
+	removed := difference(trackedRooms, actualRooms)
+	if len(added) == 0 && len(removed) == 0 {
+		agentLoad.WithLabelValues(agentID).Set(float64(len(trackedRooms)))
+		return nil, nil
+	}
+
+	// Rooms reserved recently may not show up in Qiscus yet
+	correction, err := u.agentRepo.CorrectRooms(agentID, removed, added, snapshotAt, snapshotAt.Add(-reconcileGracePeriod))
+	if err != nil {
+		return nil, fmt.Errorf("failed to correct agent rooms: %w", err)
+	}
+
+	agentLoad.WithLabelValues(agentID).Set(float64(correction.Load))
+
+	if len(correction.Added) == 0 && len(correction.Removed) == 0 {
+		return nil, nil
+	}
+
+	return &entity.CapacityCorrection{
+		AgentID:      agentID,
+		Before:       len(trackedRooms),
+		After:        correction.Load,
+		AddedRooms:   correction.Added,
+		RemovedRooms: correction.Removed,
+	}, nil
+}
+
+// ManualAssign assigns the room to the agent on behalf of a supervisor, replacing
+// the agent currently serving it. The room leaves the queue and moves between
+// the agents' rooms in Redis regardless of capacity. Every attempt is audited
+// with the actor and the address the request came from.
+func (u *allocationUsecase) ManualAssign(roomID, agentID, actor, remoteAddr string) (*entity.ManualAssignment, error) {
+	previousAgentID, err := u.agentRepo.GetRoomAgent(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room agent: %w", err)
+	}
+
+	if previousAgentID == agentID {
+		return nil, ErrAlreadyAssigned
+	}
+
+	entry := entity.AuditEntry{
+		Timestamp:       time.Now().Unix(),
+		Actor:           actor,
+		RemoteAddr:      remoteAddr,
+		Action:          AuditActionAssign,
+		RoomID:          roomID,
+		AgentID:         agentID,
+		PreviousAgentID: previousAgentID,
+	}
+	if previousAgentID != "" {
+		entry.Action = AuditActionReassign
+	}
+
+	result, err := u.manualAssign(roomID, agentID, previousAgentID)
+	if result != nil {
+		entry.PreviousAgentID = result.PreviousAgentID
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	u.audit(entry)
+
+	return result, err
+}
+
+func (u *allocationUsecase) manualAssign(roomID, agentID, previousAgentID string) (*entity.ManualAssignment, error) {
+	// Close the room before Qiscus is called so a worker holding it in flight
+	// neither reserves it nor assigns a second agent
+	closedAt := time.Now()
+	if err := u.queueRepo.MarkClosed(roomID, closedAt, closedMarkerTTL); err != nil {
+		return nil, fmt.Errorf("failed to mark room closed: %w", err)
+	}
+
+	// Always replace, Redis may not know the agent Qiscus has on the room
+	if err := u.agentQiscusRepo.ReassignAgent(roomID, agentID); err != nil {
+		// Let workers pick the room up again unless it was closed since
+		if err := u.queueRepo.ClearClosed(roomID, closedAt); err != nil {
+			log.Printf("Failed to clear closed marker of room %s: %v", roomID, err)
+		}
+		return nil, fmt.Errorf("failed to reassign agent: %w", err)
+	}
+
+	result := &entity.ManualAssignment{
+		RoomID:          roomID,
+		AgentID:         agentID,
+		PreviousAgentID: previousAgentID,
+	}
+
+	removed, err := u.RemoveFromQueue(roomID)
+	if err != nil {
+		return result, err
+	}
+	result.RemovedFromQueue = removed
+
+	// Another instance may move the room meanwhile; Qiscus replaced whichever
+	// agent held it, so release that one instead
+	for attempt := 1; ; attempt++ {
+		load, moved, err := u.agentRepo.MoveRoom(roomID, result.PreviousAgentID, agentID)
+		if err != nil {
+			return result, fmt.Errorf("failed to move room: %w", err)
+		}
+
+		if moved {
+			result.AgentLoad = load
+			break
+		}
+
+		if attempt == moveRoomAttempts {
+			return result, fmt.Errorf("room %s kept changing agent while being moved", roomID)
+		}
+
+		result.PreviousAgentID, err = u.agentRepo.GetRoomAgent(roomID)
+		if err != nil {
+			return result, fmt.Errorf("failed to get room agent: %w", err)
+		}
+	}
+
+	agentLoad.WithLabelValues(agentID).Set(float64(result.AgentLoad))
+	if result.PreviousAgentID != "" {
+		if _, err := u.GetAgentCapacity(result.PreviousAgentID); err != nil {
+			log.Printf("Failed to refresh load of agent %s: %v", result.PreviousAgentID, err)
+		}
+	}
+
+	maxCapacity, err := u.GetAgentMaxCapacity(agentID)
+	if err != nil {
+		return result, err
+	}
+	result.AgentMaxCapacity = maxCapacity
+
+	if result.AgentLoad > maxCapacity {
+		log.Printf("Agent %s is over capacity after manual assignment (%d/%d)", agentID, result.AgentLoad, maxCapacity)
+	}
+
+	return result, nil
+}
+
+// audit records the entry in the audit log. Failing to record never fails the action.
+func (u *allocationUsecase) audit(entry entity.AuditEntry) {
+	log.Printf("Audit: %s (%s) %s room %s to agent %s (previous: %q, error: %q)",
+		entry.Actor, entry.RemoteAddr, entry.Action, entry.RoomID, entry.AgentID, entry.PreviousAgentID, entry.Error)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v", err)
+		return
+	}
+
+	if err := u.auditRepo.Append(string(data)); err != nil {
+		log.Printf("Failed to record audit entry: %v", err)
+	}
+}
+
+// ListAuditLog returns up to limit audit entries, newest first
+func (u *allocationUsecase) ListAuditLog(limit int) ([]entity.AuditEntry, error) {
+	data, err := u.auditRepo.List(limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+
+	entries := make([]entity.AuditEntry, 0, len(data))
+	for _, d := range data {
+		var entry entity.AuditEntry
+		if err := json.Unmarshal([]byte(d), &entry); err != nil {
+			log.Printf("Skipping malformed audit entry: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// difference returns items of a that are not in b
+func difference(a, b []string) []string {
+	seen := make(map[string]bool, len(b))
+	for _, item := range b {
+		seen[item] = true
+	}
+
+	var result []string
+	for _, item := range a {
+		if !seen[item] {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,262 @@
+package usecase
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateLayout is the format of holiday dates
+const dateLayout = "2006-01-02"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// BusinessHoursSchedule configures when a channel, or the agents of a
+// division, are available. Hours maps a weekday ("mon".."sun") to one or more
+// comma separated ranges, e.g. "08:00-12:00,13:00-17:00". Days without hours
+// and holidays ("2006-01-02") are closed.
+type BusinessHoursSchedule struct {
+	Channel           string
+	DivisionID        int
+	Timezone          string
+	Hours             map[string]string
+	Holidays          []string
+	AfterHoursMessage string
+}
+
+// BusinessHours tells whether the segment serving a channel is open. A
+// channel uses its own schedule, otherwise the schedules of the divisions it
+// is routed to (open while any of them is), otherwise the "*" schedule.
+// Channels without any schedule are always open.
+type BusinessHours struct {
+	channels  map[string]*schedule
+	divisions map[int]*schedule
+	routes    DivisionRoutes
+}
+
+type schedule struct {
+	location *time.Location
+	hours    map[time.Weekday][]timeRange
+	holidays map[string]bool
+	message  string
+}
+
+// timeRange is an opening range in minutes since midnight, end exclusive
+type timeRange struct {
+	start int
+	end   int
+}
+
+// NewBusinessHours validates the schedules. It returns nil, meaning always
+// open, when there are no schedules.
+func NewBusinessHours(schedules []BusinessHoursSchedule, routes DivisionRoutes) (*BusinessHours, error) {
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+
+	b := &BusinessHours{
+		channels:  make(map[string]*schedule),
+		divisions: make(map[int]*schedule),
+		routes:    routes,
+	}
+
+	for i, config := range schedules {
+		s, err := newSchedule(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid business hours schedule %d: %w", i, err)
+		}
+
+		switch {
+		case config.DivisionID > 0:
+			b.divisions[config.DivisionID] = s
+		case config.Channel != "":
+			b.channels[strings.ToLower(config.Channel)] = s
+		default:
+			return nil, fmt.Errorf("invalid business hours schedule %d: channel or division_id is required", i)
+		}
+	}
+
+	return b, nil
+}
+
+func newSchedule(config BusinessHoursSchedule) (*schedule, error) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", config.Timezone, err)
+	}
+
+	s := &schedule{
+		location: location,
+		hours:    make(map[time.Weekday][]timeRange),
+		holidays: make(map[string]bool),
+		message:  config.AfterHoursMessage,
+	}
+
+	for day, ranges := range config.Hours {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", day)
+		}
+
+		for _, value := range strings.Split(ranges, ",") {
+			r, err := parseTimeRange(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid hours for %s: %w", day, err)
+			}
+			s.hours[weekday] = append(s.hours[weekday], r)
+		}
+
+		sort.Slice(s.hours[weekday], func(i, j int) bool {
+			return s.hours[weekday][i].start < s.hours[weekday][j].start
+		})
+	}
+
+	for _, holiday := range config.Holidays {
+		if _, err := time.Parse(dateLayout, holiday); err != nil {
+			return nil, fmt.Errorf("invalid holiday %q, expected YYYY-MM-DD", holiday)
+		}
+		s.holidays[holiday] = true
+	}
+
+	return s, nil
+}
+
+// parseTimeRange parses "HH:MM-HH:MM", where the end may be 24:00
+func parseTimeRange(value string) (timeRange, error) {
+	from, to, found := strings.Cut(value, "-")
+	if !found {
+		return timeRange{}, fmt.Errorf("%q, expected HH:MM-HH:MM", value)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return timeRange{}, err
+	}
+
+	end, err := parseClock(to)
+	if err != nil {
+		return timeRange{}, err
+	}
+
+	if start >= end {
+		return timeRange{}, fmt.Errorf("%q, start must be before end", value)
+	}
+
+	return timeRange{start: start, end: end}, nil
+}
+
+// parseClock returns the minutes since midnight of "HH:MM"
+func parseClock(value string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(strings.TrimSpace(value), "%d:%d", &hour, &minute); err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// Check reports whether the segment serving channel is closed at t. When it
+// is, opensAt is the next opening time and message the after-hours reply.
+func (b *BusinessHours) Check(channel string, t time.Time) (closed bool, opensAt time.Time, message string) {
+	schedules := b.schedulesFor(channel)
+	if len(schedules) == 0 {
+		return false, time.Time{}, ""
+	}
+
+	for _, s := range schedules {
+		if s.isOpen(t) {
+			return false, time.Time{}, ""
+		}
+
+		next := s.nextOpen(t)
+		if !next.IsZero() && (opensAt.IsZero() || next.Before(opensAt)) {
+			opensAt = next
+			message = s.message
+		}
+	}
+
+	if opensAt.IsZero() {
+		// No opening in sight, check again tomorrow
+		return true, t.Add(24 * time.Hour), schedules[0].message
+	}
+
+	return true, opensAt, message
+}
+
+func (b *BusinessHours) schedulesFor(channel string) []*schedule {
+	if b == nil {
+		return nil
+	}
+
+	channel = strings.ToLower(channel)
+	if s, ok := b.channels[channel]; ok {
+		return []*schedule{s}
+	}
+
+	var schedules []*schedule
+	for _, division := range b.routes.DivisionsFor(channel) {
+		if s, ok := b.divisions[division]; ok {
+			schedules = append(schedules, s)
+		}
+	}
+	if len(schedules) > 0 {
+		return schedules
+	}
+
+	if s, ok := b.channels[DefaultDivisionRoute]; ok {
+		return []*schedule{s}
+	}
+
+	return nil
+}
+
+func (s *schedule) isOpen(t time.Time) bool {
+	local := t.In(s.location)
+	if s.holidays[local.Format(dateLayout)] {
+		return false
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range s.hours[local.Weekday()] {
+		if minute >= r.start && minute < r.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextOpen returns the start of the first opening range after t within a
+// year, zero if there is none
+func (s *schedule) nextOpen(t time.Time) time.Time {
+	local := t.In(s.location)
+
+	for day := 0; day <= 366; day++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+day, 0, 0, 0, 0, s.location)
+		if s.holidays[date.Format(dateLayout)] {
+			continue
+		}
+
+		for _, r := range s.hours[date.Weekday()] {
+			opens := time.Date(date.Year(), date.Month(), date.Day(), r.start/60, r.start%60, 0, 0, s.location)
+			if opens.After(local) {
+				return opens
+			}
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,232 @@
+package usecase
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    timeRange
+		wantErr bool
+	}{
+		{value: "08:00-17:00", want: timeRange{start: 480, end: 1020}},
+		{value: "8:30-12:15", want: timeRange{start: 510, end: 735}},
+		{value: " 20:00 - 24:00 ", want: timeRange{start: 1200, end: 1440}},
+		{value: "00:00-24:00", want: timeRange{start: 0, end: 1440}},
+		{value: "17:00-08:00", wantErr: true},
+		{value: "08:00-08:00", wantErr: true},
+		{value: "08:00", wantErr: true},
+		{value: "08:00-24:01", wantErr: true},
+		{value: "25:00-26:00", wantErr: true},
+		{value: "08:60-09:00", wantErr: true},
+		{value: "-1:00-09:00", wantErr: true},
+		{value: "morning-evening", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimeRange(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeRange(%q) = %+v, want error", tt.value, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseTimeRange(%q) returned error: %v", tt.value, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("parseTimeRange(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func mustSchedule(t *testing.T, config BusinessHoursSchedule) *schedule {
+	t.Helper()
+
+	s, err := newSchedule(config)
+	if err != nil {
+		t.Fatalf("newSchedule: %v", err)
+	}
+
+	return s
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+
+	return location
+}
+
+func TestScheduleIsOpen(t *testing.T) {
+	jakarta := mustLocation(t, "Asia/Jakarta")
+	s := mustSchedule(t, BusinessHoursSchedule{
+		Timezone: "Asia/Jakarta",
+		Hours: map[string]string{
+			"mon": "08:00-12:00,13:00-17:00",
+			"Sat": "20:00-24:00",
+		},
+		Holidays: []string{"2024-12-30"},
+	})
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want bool
+	}{
+		{"before opening", time.Date(2024, 12, 23, 7, 59, 0, 0, jakarta), false},
+		{"at opening", time.Date(2024, 12, 23, 8, 0, 0, 0, jakarta), true},
+		{"lunch break", time.Date(2024, 12, 23, 12, 30, 0, 0, jakarta), false},
+		{"afternoon", time.Date(2024, 12, 23, 16, 59, 0, 0, jakarta), true},
+		{"at closing", time.Date(2024, 12, 23, 17, 0, 0, 0, jakarta), false},
+		{"day without hours", time.Date(2024, 12, 24, 10, 0, 0, 0, jakarta), false},
+		{"range ending at 24:00", time.Date(2024, 12, 28, 23, 59, 0, 0, jakarta), true},
+		{"after range ending at 24:00", time.Date(2024, 12, 29, 0, 0, 0, 0, jakarta), false},
+		{"holiday", time.Date(2024, 12, 30, 10, 0, 0, 0, jakarta), false},
+		{"converted from UTC", time.Date(2024, 12, 23, 2, 0, 0, 0, time.UTC), true},
+		{"UTC time on the previous day", time.Date(2024, 12, 22, 23, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		if got := s.isOpen(tt.at); got != tt.want {
+			t.Errorf("%s: isOpen(%s) = %v, want %v", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextOpen(t *testing.T) {
+	jakarta := mustLocation(t, "Asia/Jakarta")
+	newYork := mustLocation(t, "America/New_York")
+
+	weekdays := mustSchedule(t, BusinessHoursSchedule{
+		Timezone: "Asia/Jakarta",
+		Hours: map[string]string{
+			"mon": "08:00-12:00,13:00-17:00",
+			"tue": "08:00-17:00",
+			"fri": "08:00-17:00",
+		},
+		Holidays: []string{"2024-12-30"},
+	})
+	us := mustSchedule(t, BusinessHoursSchedule{
+		Timezone: "America/New_York",
+		Hours:    map[string]string{"mon": "08:00-17:00"},
+	})
+	never := mustSchedule(t, BusinessHoursSchedule{Timezone: "UTC"})
+
+	tests := []struct {
+		name string
+		s    *schedule
+		at   time.Time
+		want time.Time
+	}{
+		{"later today", weekdays, time.Date(2024, 12, 23, 6, 0, 0, 0, jakarta), time.Date(2024, 12, 23, 8, 0, 0, 0, jakarta)},
+		{"after lunch", weekdays, time.Date(2024, 12, 23, 12, 0, 0, 0, jakarta), time.Date(2024, 12, 23, 13, 0, 0, 0, jakarta)},
+		{"while open", weekdays, time.Date(2024, 12, 23, 8, 0, 0, 0, jakarta), time.Date(2024, 12, 23, 13, 0, 0, 0, jakarta)},
+		{"next day", weekdays, time.Date(2024, 12, 23, 18, 0, 0, 0, jakarta), time.Date(2024, 12, 24, 8, 0, 0, 0, jakarta)},
+		{"over the weekend", weekdays, time.Date(2024, 12, 20, 18, 0, 0, 0, jakarta), time.Date(2024, 12, 23, 8, 0, 0, 0, jakarta)},
+		{"skips holiday", weekdays, time.Date(2024, 12, 27, 18, 0, 0, 0, jakarta), time.Date(2024, 12, 31, 8, 0, 0, 0, jakarta)},
+		{"DST starts over the weekend", us, time.Date(2024, 3, 8, 18, 0, 0, 0, newYork), time.Date(2024, 3, 11, 12, 0, 0, 0, time.UTC)},
+		{"DST ends over the weekend", us, time.Date(2024, 11, 1, 18, 0, 0, 0, newYork), time.Date(2024, 11, 4, 13, 0, 0, 0, time.UTC)},
+		{"never opens", never, time.Date(2024, 12, 23, 8, 0, 0, 0, time.UTC), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.s.nextOpen(tt.at); !got.Equal(tt.want) {
+			t.Errorf("%s: nextOpen(%s) = %s, want %s", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestBusinessHoursCheck(t *testing.T) {
+	jakarta := mustLocation(t, "Asia/Jakarta")
+	routes := DivisionRoutes{"whatsapp": {1, 2}, "instagram": {3}}
+
+	b, err := NewBusinessHours([]BusinessHoursSchedule{
+		{DivisionID: 1, Timezone: "Asia/Jakarta", Hours: map[string]string{"mon": "08:00-12:00"}, AfterHoursMessage: "sales closed"},
+		{DivisionID: 2, Timezone: "Asia/Jakarta", Hours: map[string]string{"mon": "13:00-17:00"}, AfterHoursMessage: "support closed"},
+		{Channel: "Telegram", Timezone: "Asia/Jakarta", Hours: map[string]string{"tue": "09:00-10:00"}, AfterHoursMessage: "telegram closed"},
+		{Channel: DefaultDivisionRoute, Timezone: "Asia/Jakarta", Hours: map[string]string{"mon": "00:00-24:00"}, AfterHoursMessage: "closed"},
+	}, routes)
+	if err != nil {
+		t.Fatalf("NewBusinessHours: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		channel     string
+		at          time.Time
+		wantClosed  bool
+		wantOpensAt time.Time
+		wantMessage string
+	}{
+		{"first division open", "whatsapp", time.Date(2024, 12, 23, 10, 0, 0, 0, jakarta), false, time.Time{}, ""},
+		{"second division open", "WhatsApp", time.Date(2024, 12, 23, 14, 0, 0, 0, jakarta), false, time.Time{}, ""},
+		{"between divisions", "whatsapp", time.Date(2024, 12, 23, 12, 30, 0, 0, jakarta),
+			true, time.Date(2024, 12, 23, 13, 0, 0, 0, jakarta), "support closed"},
+		{"before both divisions", "whatsapp", time.Date(2024, 12, 23, 7, 0, 0, 0, jakarta),
+			true, time.Date(2024, 12, 23, 8, 0, 0, 0, jakarta), "sales closed"},
+		{"channel schedule wins", "telegram", time.Date(2024, 12, 23, 10, 0, 0, 0, jakarta),
+			true, time.Date(2024, 12, 24, 9, 0, 0, 0, jakarta), "telegram closed"},
+		{"division without schedule falls back to default", "instagram", time.Date(2024, 12, 24, 10, 0, 0, 0, jakarta),
+			true, time.Date(2024, 12, 30, 0, 0, 0, 0, jakarta), "closed"},
+		{"default schedule", "line", time.Date(2024, 12, 23, 10, 0, 0, 0, jakarta), false, time.Time{}, ""},
+	}
+
+	for _, tt := range tests {
+		closed, opensAt, message := b.Check(tt.channel, tt.at)
+		if closed != tt.wantClosed || !opensAt.Equal(tt.wantOpensAt) || message != tt.wantMessage {
+			t.Errorf("%s: Check(%q, %s) = (%v, %s, %q), want (%v, %s, %q)", tt.name, tt.channel, tt.at,
+				closed, opensAt, message, tt.wantClosed, tt.wantOpensAt, tt.wantMessage)
+		}
+	}
+}
+
+func TestBusinessHoursAlwaysOpen(t *testing.T) {
+	b, err := NewBusinessHours(nil, nil)
+	if err != nil {
+		t.Fatalf("NewBusinessHours: %v", err)
+	}
+
+	if closed, _, _ := b.Check("whatsapp", time.Now()); closed {
+		t.Error("Check without schedules = closed, want open")
+	}
+
+	b, err = NewBusinessHours([]BusinessHoursSchedule{
+		{Channel: "telegram", Timezone: "UTC", Hours: map[string]string{"mon": "09:00-10:00"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewBusinessHours: %v", err)
+	}
+
+	if closed, _, _ := b.Check("whatsapp", time.Date(2024, 12, 24, 3, 0, 0, 0, time.UTC)); closed {
+		t.Error("Check for channel without schedule = closed, want open")
+	}
+}
+
+func TestNewBusinessHoursInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule BusinessHoursSchedule
+	}{
+		{"unknown timezone", BusinessHoursSchedule{Channel: "wa", Timezone: "Mars/Olympus"}},
+		{"unknown weekday", BusinessHoursSchedule{Channel: "wa", Timezone: "UTC", Hours: map[string]string{"funday": "08:00-17:00"}}},
+		{"invalid range", BusinessHoursSchedule{Channel: "wa", Timezone: "UTC", Hours: map[string]string{"mon": "17:00-08:00"}}},
+		{"invalid holiday", BusinessHoursSchedule{Channel: "wa", Timezone: "UTC", Holidays: []string{"25/12/2024"}}},
+		{"no channel or division", BusinessHoursSchedule{Timezone: "UTC"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewBusinessHours([]BusinessHoursSchedule{tt.schedule}, nil); err == nil {
+			t.Errorf("%s: NewBusinessHours returned no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package usecase
+
+import "strings"
+
+// DefaultDivisionRoute is the routing table key used for channels without their own entry
+const DefaultDivisionRoute = "*"
+
+// DivisionRoutes maps a channel (webhook source) to the Qiscus divisions
+// whose agents may serve it
+type DivisionRoutes map[string][]int
+
+// DivisionsFor returns the divisions for a channel, falling back to the
+// default route. Empty means any agent may serve the channel.
+func (r DivisionRoutes) DivisionsFor(channel string) []int {
+	if divisions, ok := r[strings.ToLower(channel)]; ok {
+		return divisions
+	}
+
+	return r[DefaultDivisionRoute]
+}
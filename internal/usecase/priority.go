@@ -0,0 +1,38 @@
+package usecase
+
+import (
+	"strings"
+
+	"qiscus-agent-allocation/internal/domain/entity"
+)
+
+// priorityStep separates priorities in the queue score. It is larger than any
+// unix millisecond timestamp, so a higher priority always comes first and
+// items with the same priority stay in enqueue order.
+const priorityStep = 1e13
+
+// PriorityRules derive a queue item's priority. The highest matching rule wins.
+type PriorityRules struct {
+	VIPEmails         []string
+	VIPPriority       int
+	ChannelPriorities map[string]int
+}
+
+// PriorityFor returns the priority of an item according to the rules, 0 when none match
+func (r PriorityRules) PriorityFor(item entity.QueueItem) int {
+	priority := r.ChannelPriorities[strings.ToLower(item.Channel)]
+
+	for _, email := range r.VIPEmails {
+		if strings.EqualFold(email, item.CustomerID) && r.VIPPriority > priority {
+			priority = r.VIPPriority
+			break
+		}
+	}
+
+	return priority
+}
+
+// queueScore orders the queue by priority (highest first), then by enqueue time (oldest first)
+func queueScore(item entity.QueueItem) float64 {
+	return -float64(item.Priority)*priorityStep + float64(item.Timestamp.UnixMilli())
+}
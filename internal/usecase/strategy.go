@@ -0,0 +1,165 @@
+package usecase
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"qiscus-agent-allocation/internal/domain/entity"
+	"qiscus-agent-allocation/internal/repository/redis"
+)
+
+const (
+	StrategyLeastLoaded           = "least_loaded"
+	StrategyRoundRobin            = "round_robin"
+	StrategyLeastRecentlyAssigned = "least_recently_assigned"
+	StrategyWeightedRandom        = "weighted_random"
+)
+
+// AgentCandidate is an online agent with free capacity
+type AgentCandidate struct {
+	Agent       entity.Agent
+	Load        int
+	MaxCapacity int
+}
+
+// AllocationStrategy decides which agent gets the next customer. Order returns
+// the candidates in the order a slot should be reserved; the worker moves on
+// to the next one when another worker fills an agent first.
+type AllocationStrategy interface {
+	Name() string
+	Order(candidates []AgentCandidate) ([]AgentCandidate, error)
+}
+
+// NewAllocationStrategy returns the strategy registered under name
+func NewAllocationStrategy(name string, agentRepo redis.AgentRepository) (AllocationStrategy, error) {
+	switch name {
+	case "", StrategyLeastLoaded:
+		return &leastLoadedStrategy{}, nil
+	case StrategyRoundRobin:
+		return &roundRobinStrategy{agentRepo: agentRepo}, nil
+	case StrategyLeastRecentlyAssigned:
+		return &leastRecentlyAssignedStrategy{agentRepo: agentRepo}, nil
+	case StrategyWeightedRandom:
+		return &weightedRandomStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy %q", name)
+	}
+}
+
+// leastLoadedStrategy prefers the agent with the fewest active customers
+type leastLoadedStrategy struct{}
+
+func (s *leastLoadedStrategy) Name() string {
+	return StrategyLeastLoaded
+}
+
+func (s *leastLoadedStrategy) Order(candidates []AgentCandidate) ([]AgentCandidate, error) {
+	ordered := append([]AgentCandidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Load < ordered[j].Load
+	})
+
+	return ordered, nil
+}
+
+// roundRobinStrategy takes turns over agents sorted by ID, using a counter
+// in Redis so turns are shared between instances
+type roundRobinStrategy struct {
+	agentRepo redis.AgentRepository
+}
+
+func (s *roundRobinStrategy) Name() string {
+	return StrategyRoundRobin
+}
+
+func (s *roundRobinStrategy) Order(candidates []AgentCandidate) ([]AgentCandidate, error) {
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	sorted := append([]AgentCandidate(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Agent.ID < sorted[j].Agent.ID
+	})
+
+	next, err := s.agentRepo.NextRoundRobin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get round robin position: %w", err)
+	}
+
+	offset := int(next % int64(len(sorted)))
+	return append(sorted[offset:], sorted[:offset]...), nil
+}
+
+// leastRecentlyAssignedStrategy prefers the agent who waited longest since
+// their last assignment
+type leastRecentlyAssignedStrategy struct {
+	agentRepo redis.AgentRepository
+}
+
+func (s *leastRecentlyAssignedStrategy) Name() string {
+	return StrategyLeastRecentlyAssigned
+}
+
+func (s *leastRecentlyAssignedStrategy) Order(candidates []AgentCandidate) ([]AgentCandidate, error) {
+	agentIDs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		agentIDs = append(agentIDs, c.Agent.ID)
+	}
+
+	lastAssigned, err := s.agentRepo.GetLastAssigned(agentIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last assigned time: %w", err)
+	}
+
+	ordered := append([]AgentCandidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return lastAssigned[ordered[i].Agent.ID] < lastAssigned[ordered[j].Agent.ID]
+	})
+
+	return ordered, nil
+}
+
+// weightedRandomStrategy picks agents at random, weighted by free slots, so
+// load spreads out without always hitting the same agent first
+type weightedRandomStrategy struct{}
+
+func (s *weightedRandomStrategy) Name() string {
+	return StrategyWeightedRandom
+}
+
+func (s *weightedRandomStrategy) Order(candidates []AgentCandidate) ([]AgentCandidate, error) {
+	remaining := append([]AgentCandidate(nil), candidates...)
+	ordered := make([]AgentCandidate, 0, len(candidates))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, c := range remaining {
+			total += weight(c)
+		}
+
+		pick := rand.Intn(total)
+		index := 0
+		for i, c := range remaining {
+			pick -= weight(c)
+			if pick < 0 {
+				index = i
+				break
+			}
+		}
+
+		ordered = append(ordered, remaining[index])
+		remaining = append(remaining[:index], remaining[index+1:]...)
+	}
+
+	return ordered, nil
+}
+
+// weight is the number of free slots, at least 1 so every candidate can be picked
+func weight(c AgentCandidate) int {
+	if free := c.MaxCapacity - c.Load; free > 1 {
+		return free
+	}
+	return 1
+}
@@ -6,22 +6,40 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"qiscus-agent-allocation/internal/domain/entity"
+	"strconv"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	apiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "qiscus_api_request_duration_seconds",
+		Help: "Duration of Qiscus API requests, by endpoint.",
+	}, []string{"endpoint"})
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qiscus_api_requests_total",
+		Help: "Qiscus API requests by endpoint and status code, code \"error\" when there was no response.",
+	}, []string{"endpoint", "code"})
 )
 
 type Client struct {
-	baseURL    string
-	appID      string
-	secretKey  string
-	httpClient *http.Client
+	baseURL     string
+	appID       string
+	secretKey   string
+	senderEmail string
+	httpClient  *http.Client
 }
 
 type Config struct {
-	BaseURL   string
-	AppID     string
-	SecretKey string
-	Timeout   time.Duration
+	BaseURL     string
+	AppID       string
+	SecretKey   string
+	SenderEmail string
+	Timeout     time.Duration
 }
 
 func NewClient(config Config) *Client {
@@ -33,16 +51,37 @@ func NewClient(config Config) *Client {
 		config.BaseURL = "https://omnichannel.qiscus.com"
 	}
 
+	if config.SenderEmail == "" {
+		// Default admin account of the app, used as sender of bot messages
+		config.SenderEmail = config.AppID + "_admin@qismo.com"
+	}
+
 	return &Client{
-		baseURL:   config.BaseURL,
-		appID:     config.AppID,
-		secretKey: config.SecretKey,
+		baseURL:     config.BaseURL,
+		appID:       config.AppID,
+		secretKey:   config.SecretKey,
+		senderEmail: config.SenderEmail,
 		httpClient: &http.Client{
 			Timeout: config.Timeout,
 		},
 	}
 }
 
+// do sends the request, recording its duration and status code under endpoint
+func (c *Client) do(req *http.Request, endpoint string) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	apiDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(endpoint, code).Inc()
+
+	return resp, err
+}
+
 func (c *Client) GetAgents() ([]entity.QiscusAgent, error) {
 	url := "/api/v2/admin/agents"
 
@@ -56,7 +95,52 @@ func (c *Client) GetAgents() ([]entity.QiscusAgent, error) {
 	req.Header.Set("Qiscus-Secret-Key", c.secretKey)
 
 	// Make HTTP request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, "get_agents")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// Check status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Parse JSON response
+	var response entity.GetAgentsResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return response.Data.Agents, nil
+}
+
+// GetAgentsByDivision lists agents belonging to any of the given divisions
+func (c *Client) GetAgentsByDivision(divisionIDs []int) ([]entity.QiscusAgent, error) {
+	endpoint := "/api/v2/admin/agents/by_division"
+
+	query := url.Values{}
+	for _, id := range divisionIDs {
+		query.Add("division_ids[]", strconv.Itoa(id))
+	}
+
+	req, err := http.NewRequest("GET", c.baseURL+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Qiscus-App-Id", c.appID)
+	req.Header.Set("Qiscus-Secret-Key", c.secretKey)
+
+	// Make HTTP request
+	resp, err := c.do(req, "get_agents_by_division")
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
@@ -83,12 +167,70 @@ func (c *Client) GetAgents() ([]entity.QiscusAgent, error) {
 }
 
 func (c *Client) AssignAgent(roomID, agentID string) error {
+	return c.assignAgent(entity.AssignAgentRequest{
+		RoomID:  roomID,
+		AgentID: agentID,
+	})
+}
+
+// ReassignAgent moves a room to another agent, replacing the agent serving it
+func (c *Client) ReassignAgent(roomID, agentID string) error {
+	return c.assignAgent(entity.AssignAgentRequest{
+		RoomID:             roomID,
+		AgentID:            agentID,
+		ReplaceLatestAgent: true,
+	})
+}
+
+func (c *Client) assignAgent(requestBody entity.AssignAgentRequest) error {
 	url := "/api/v1/admin/service/assign_agent"
 
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add authentication headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Qiscus-App-Id", c.appID)
+	req.Header.Set("Qiscus-Secret-Key", c.secretKey)
+
+	// Make HTTP request
+	resp, err := c.do(req, "assign_agent")
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// Check status code
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// SendMessage posts a text message to a room as the app's bot
+func (c *Client) SendMessage(roomID, message string) error {
+	url := "/" + c.appID + "/bot"
+
 	// Prepare request body
-	requestBody := entity.AssignAgentRequest{
-		RoomID:  roomID,
-		AgentID: agentID,
+	requestBody := entity.SendMessageRequest{
+		SenderEmail: c.senderEmail,
+		Message:     message,
+		Type:        "text",
+		RoomID:      roomID,
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
@@ -107,7 +249,7 @@ func (c *Client) AssignAgent(roomID, agentID string) error {
 	req.Header.Set("Qiscus-Secret-Key", c.secretKey)
 
 	// Make HTTP request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, "send_message")
 	if err != nil {
 		return fmt.Errorf("failed to make request: %w", err)
 	}
@@ -126,3 +268,69 @@ func (c *Client) AssignAgent(roomID, agentID string) error {
 
 	return nil
 }
+
+// GetAgentActiveRooms lists rooms currently served by an agent, following pagination
+func (c *Client) GetAgentActiveRooms(agentID int) ([]entity.CustomerRoom, error) {
+	url := "/api/v2/customer_rooms"
+
+	var rooms []entity.CustomerRoom
+	cursor := ""
+
+	for {
+		requestBody := entity.GetCustomerRoomsRequest{
+			Status:      "unresolved",
+			ServeStatus: "served",
+			AgentIDs:    []int{agentID},
+			Limit:       50,
+			CursorAfter: cursor,
+		}
+
+		jsonBody, err := json.Marshal(requestBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+
+		req, err := http.NewRequest("POST", c.baseURL+url, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		// Add authentication headers
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Qiscus-App-Id", c.appID)
+		req.Header.Set("Qiscus-Secret-Key", c.secretKey)
+
+		// Make HTTP request
+		resp, err := c.do(req, "get_customer_rooms")
+		if err != nil {
+			return nil, fmt.Errorf("failed to make request: %w", err)
+		}
+
+		// Read response body
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Check status code
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		}
+
+		// Parse JSON response
+		var response entity.GetCustomerRoomsResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+
+		rooms = append(rooms, response.Data.CustomerRooms...)
+
+		if response.Meta.CursorAfter == "" || len(response.Data.CustomerRooms) == 0 {
+			break
+		}
+		cursor = response.Meta.CursorAfter
+	}
+
+	return rooms, nil
+}
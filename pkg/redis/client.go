@@ -3,15 +3,20 @@ package redis
 import (
 	"context"
 	"fmt"
+	"runtime"
 
 	"github.com/go-redis/redis/v8"
 )
 
-func NewClient(redisURL string) (*redis.Client, error) {
+// NewClient connects to Redis. blockingConns connections (one per queue
+// worker waiting on the queue) are added to go-redis' default pool of 10 per
+// CPU, so waiting workers don't starve webhooks and the admin API.
+func NewClient(redisURL string, blockingConns int) (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     redisURL,
 		Password: "",
 		DB:       0,
+		PoolSize: 10*runtime.GOMAXPROCS(0) + blockingConns,
 	})
 
 	// Test connection